@@ -23,26 +23,30 @@
 // Package ast declares structures used to represent mexdown syntax trees.
 package ast // import "akhil.cc/mexdown/ast"
 
+import "strings"
+
 // All Node types implement the Node interface.
 //
-//go:generate sumgen Node = *File | *Header | *Directive | *List | ListItem | *Paragraph | Text
+//go:generate sumgen Node = *File | *Header | *Directive | *List | ListItem | *Paragraph | Text | *Table | TableRow | TableCell | *Quote | *Footnote | *Rule | *PageBreak | *Comment
 type Node interface {
 	node()
 }
 
 // All statement nodes implement the Stmt interface.
 //
-//go:generate sumgen Stmt = *Header | *Directive | *List | *Paragraph | *Citation
+//go:generate sumgen Stmt = *Header | *Directive | *List | *Paragraph | *Citation | *Table | *Quote | *Footnote | *Rule | *PageBreak | *Comment
 type Stmt interface {
 	Node
 	stmt()
 }
 
 // File represents a mexdown source file. It stores a list of statements representing
-// the source text and citations referenced by any links in the source.
+// the source text, citations referenced by any links in the source, and the metadata
+// given in the file's front matter, such as its title or author.
 type File struct {
 	List []Stmt
 	Cite map[string]string
+	Meta map[string]string
 }
 
 // A Header statement represents a multi-level section heading.
@@ -52,9 +56,13 @@ type Header struct {
 }
 
 // A Directive statement represents either raw (preformatted) text, or an input string to pass into a command.
+// Its attributes hold metadata about the directive, such as an id or caption, that is not passed to the command.
 type Directive struct {
 	Command string
 	Raw     string
+	Line    int               // Line number of the opening backticks
+	Attrs   map[string]string // Attributes in braces following the opening backticks
+	File    string            // Name of the file containing the directive, if known
 }
 
 // A List statement represents a sequence of list items.
@@ -63,12 +71,86 @@ type List struct {
 }
 
 // A ListItem node represents text preceded by a label.
+// An ordered item is numbered, counting from its start number if it has one.
+// An item with a checkbox is a task, which is either open or done.
 type ListItem struct {
-	NTab  int // Number of preceding tab characters '\t'
-	Label string
-	Text  Text
+	NTab     int   // Number of preceding tab characters '\t'
+	Ordered  bool  // Whether the item is numbered
+	Start    int   // Number to start counting from, if HasStart is set
+	HasStart bool  // Whether the item was given a start number
+	Check    Check // State of the item's checkbox, if it is a task
+	Label    Text  // Formatted text of the label in brackets, if any
+	Text     Text
+}
+
+// A Check is the state of a list item's checkbox.
+type Check int
+
+const (
+	CheckNone Check = iota // -
+	CheckOpen              // -[ ]
+	CheckDone              // -[x]
+)
+
+// String returns the ballot box representing c.
+// It returns the empty string for CheckNone.
+func (c Check) String() string {
+	switch c {
+	case CheckOpen:
+		return "\u2610"
+	case CheckDone:
+		return "\u2611"
+	}
+	return ""
+}
+
+// A Quote statement represents a block quotation, which holds statements of its own.
+type Quote struct {
+	List []Stmt
+}
+
+// A Rule statement represents a thematic break between sections.
+type Rule struct{}
+
+// A PageBreak statement represents a thematic break that also starts
+// a new page in paged output.
+type PageBreak struct{}
+
+// A Comment statement represents a note in the source that is not part of
+// the document, which generators skip.
+type Comment struct {
+	Text  string // Text between the comment's delimiters
+	Block bool   // Whether the comment is a block comment
 }
 
+// A Table statement represents a grid of cells. The rows preceding the table's
+// delimiter row, which sets the alignment of each column, form its header.
+type Table struct {
+	Align   []Align // Alignment of each column
+	NHeader int     // Number of header rows
+	Rows    []TableRow
+}
+
+// A TableRow node represents a sequence of table cells.
+type TableRow struct {
+	Cells []TableCell
+}
+
+// A TableCell node represents the text in a cell of a table.
+type TableCell struct {
+	Text Text
+}
+
+// An Align is the alignment of a table's column.
+type Align int
+
+const (
+	AlignNone   Align = iota // ---
+	AlignLeft                // :--
+	AlignCenter              // :-:
+	AlignRight               // --:
+)
+
 // A Citation statement represents the corresponding source for a cited label.
 // This label can be referenced in links.
 type Citation struct {
@@ -76,6 +158,13 @@ type Citation struct {
 	Src   string
 }
 
+// A Footnote statement represents the text of a footnote, which is referenced
+// by its label in other text.
+type Footnote struct {
+	Label string
+	Text  Text
+}
+
 // A Paragraph statement represents a body of text with formatting applied.
 type Paragraph struct {
 	Format []Format
@@ -96,11 +185,43 @@ type Format struct {
 type FType int
 
 const (
-	Cite          FType = iota // [src] or [label](src)
-	Italic                     // *text*
-	Bold                       // **text**
-	BoldItalic                 // ***text***
-	Underline                  // _text_
-	Strikethrough              // --text--
-	Raw                        // `text`
+	Cite            FType = iota // [src] or [label](src)
+	Italic                       // *text*
+	Bold                         // **text**
+	BoldItalic                   // ***text***
+	Underline                    // _text_
+	Strikethrough                // --text--
+	Raw                          // `text`
+	Image                        // ![src] or ![alt](src)
+	FootnoteRef                  // [^label]
+	Math                         // $tex$
+	DisplayMath                  // $$tex$$
+	InlineDirective              // `!{command}text`
+	LineBreak                    // text\ or text followed by two spaces, before a newline
 )
+
+// SplitInline splits the body of an inline directive, !{command}text, into
+// its command and text. Braces inside quotes or escaped by a backslash do not
+// end the command. The result is ok only if s has a non-empty command.
+func SplitInline(s string) (command, text string, ok bool) {
+	if !strings.HasPrefix(s, "!{") {
+		return "", "", false
+	}
+	var quote byte
+	for i := 2; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && quote != '\'':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '}':
+			command, text = s[2:i], s[i+1:]
+			return command, text, strings.TrimSpace(command) != ""
+		}
+	}
+	return "", "", false
+}
@@ -2,16 +2,30 @@
 
 package ast
 
+func (_ *Comment) node()   { panic("default implementation") }
 func (_ *Directive) node() { panic("default implementation") }
 func (_ *File) node()      { panic("default implementation") }
+func (_ *Footnote) node()  { panic("default implementation") }
 func (_ *Header) node()    { panic("default implementation") }
 func (_ *List) node()      { panic("default implementation") }
 func (_ ListItem) node()   { panic("default implementation") }
+func (_ *PageBreak) node() { panic("default implementation") }
 func (_ *Paragraph) node() { panic("default implementation") }
+func (_ *Quote) node()     { panic("default implementation") }
+func (_ *Rule) node()      { panic("default implementation") }
+func (_ *Table) node()     { panic("default implementation") }
+func (_ TableCell) node()  { panic("default implementation") }
+func (_ TableRow) node()   { panic("default implementation") }
 func (_ Text) node()       { panic("default implementation") }
 func (_ *Citation) node()  { panic("default implementation") }
 func (_ *Citation) stmt()  { panic("default implementation") }
+func (_ *Comment) stmt()   { panic("default implementation") }
 func (_ *Directive) stmt() { panic("default implementation") }
+func (_ *Footnote) stmt()  { panic("default implementation") }
 func (_ *Header) stmt()    { panic("default implementation") }
 func (_ *List) stmt()      { panic("default implementation") }
+func (_ *PageBreak) stmt() { panic("default implementation") }
 func (_ *Paragraph) stmt() { panic("default implementation") }
+func (_ *Quote) stmt()     { panic("default implementation") }
+func (_ *Rule) stmt()      { panic("default implementation") }
+func (_ *Table) stmt()     { panic("default implementation") }
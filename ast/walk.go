@@ -0,0 +1,81 @@
+// MIT License
+
+// Copyright (c) 2018 Akhil Indurti
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ast
+
+// Inspect traverses an AST in depth-first order: It starts by calling f(node);
+// node must not be nil. If f returns true, Inspect invokes f recursively for
+// each of the children of node, followed by a call of f(nil).
+func Inspect(node Node, f func(Node) bool) {
+	if !f(node) {
+		return
+	}
+	switch n := node.(type) {
+	case *File:
+		for _, s := range n.List {
+			Inspect(s, f)
+		}
+	case *Header:
+		Inspect(n.Text, f)
+	case *List:
+		for _, li := range n.Items {
+			Inspect(li, f)
+		}
+	case ListItem:
+		if len(n.Label.Body) != 0 {
+			Inspect(n.Label, f)
+		}
+		Inspect(n.Text, f)
+	case *Footnote:
+		Inspect(n.Text, f)
+	case *Quote:
+		for _, s := range n.List {
+			Inspect(s, f)
+		}
+	case *Table:
+		for _, row := range n.Rows {
+			Inspect(row, f)
+		}
+	case TableRow:
+		for _, c := range n.Cells {
+			Inspect(c, f)
+		}
+	case TableCell:
+		Inspect(n.Text, f)
+	}
+	f(nil)
+}
+
+// CountTasks returns the number of tasks in f that are done, along with
+// the total number of tasks, which are list items with a checkbox.
+func CountTasks(f *File) (done, total int) {
+	Inspect(f, func(n Node) bool {
+		if li, ok := n.(ListItem); ok && li.Check != CheckNone {
+			total++
+			if li.Check == CheckDone {
+				done++
+			}
+		}
+		return true
+	})
+	return done, total
+}
@@ -0,0 +1,892 @@
+// MIT License
+
+// Copyright (c) 2018 Akhil Indurti
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package html
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"akhil.cc/mexdown/ast"
+	sq "github.com/kballard/go-shellquote"
+)
+
+// stderrTail is the number of bytes of standard error retained
+// for a failed directive.
+const stderrTail = 1024
+
+// tailWriter retains the last max bytes written to it.
+type tailWriter struct {
+	max int
+	b   []byte
+}
+
+func (t *tailWriter) Write(p []byte) (n int, err error) {
+	t.b = append(t.b, p...)
+	if len(t.b) > t.max {
+		t.b = append(t.b[:0], t.b[len(t.b)-t.max:]...)
+	}
+	return len(p), nil
+}
+
+// A DirectiveError describes the failure of a directive's command.
+type DirectiveError struct {
+	Source   string // Name of the source file, if known
+	Line     int    // Line number of the directive
+	Index    int    // Index of the directive among all directives in the file
+	Command  string // Command line of the directive
+	ExitCode int    // Exit code of the command, or -1 if it did not exit
+	Stderr   []byte // Tail of the command's standard error
+	TimedOut bool   // Whether the command exceeded its timeout
+	Attempts int    // Number of times the command was run
+	Err      error  // The underlying error
+}
+
+func (e *DirectiveError) Error() string {
+	var b strings.Builder
+	switch {
+	case e.Source != "" && e.Line > 0:
+		fmt.Fprintf(&b, "%s:%d: ", e.Source, e.Line)
+	case e.Source != "":
+		fmt.Fprintf(&b, "%s: ", e.Source)
+	case e.Line > 0:
+		fmt.Fprintf(&b, "line %d: ", e.Line)
+	}
+	fmt.Fprintf(&b, "directive %d %q: %v", e.Index, e.Command, e.Err)
+	if e.Attempts > 1 {
+		fmt.Fprintf(&b, " (after %d attempts)", e.Attempts)
+	}
+	if stderr := strings.TrimSpace(string(e.Stderr)); stderr != "" {
+		b.WriteString("\n\t")
+		b.WriteString(strings.Replace(stderr, "\n", "\n\t", -1))
+	}
+	return b.String()
+}
+
+func (e *DirectiveError) Unwrap() error { return e.Err }
+
+// DirectiveErrors is the list of errors returned by a generator
+// that continues on error.
+type DirectiveErrors []*DirectiveError
+
+func (e DirectiveErrors) Error() string {
+	var b strings.Builder
+	for i, err := range e {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString(err.Error())
+	}
+	return b.String()
+}
+
+// directive writes the output of d to w. The raw string of a directive
+// without a command is escaped, otherwise it is passed to the command
+// as standard input. A directive with an id, class, or caption attribute
+// is wrapped in a figure.
+func (g *Generator) directive(d *ast.Directive, w io.Writer) error {
+	if figure(d) {
+		fmt.Fprint(w, "<figure")
+		for _, name := range [...]string{"id", "class"} {
+			if val, ok := d.Attrs[name]; ok {
+				fmt.Fprintf(w, " %s=\"%s\"", name, html.EscapeString(val))
+			}
+		}
+		fmt.Fprint(w, ">")
+		defer func() {
+			if caption, ok := d.Attrs["caption"]; ok {
+				fmt.Fprintf(w, "<figcaption>%s</figcaption>", html.EscapeString(caption))
+			}
+			fmt.Fprint(w, "</figure>")
+		}()
+	}
+	index := g.ndir
+	g.ndir++
+	if len(d.Command) == 0 || g.DryRun {
+		fmt.Fprintf(w, "<pre>%s</pre>", html.EscapeString(d.Raw))
+		return nil
+	}
+	out, typ, err := g.run(index, d)
+	if err == nil {
+		if eerr := g.embed(index, typ, d.Attrs["alt"], out, w); eerr != nil {
+			derr := g.directiveError(index, d)
+			derr.Err = eerr
+			err = derr
+		}
+	} else if !g.ContinueOnError {
+		w.Write(out)
+	}
+	if err != nil && g.ContinueOnError {
+		g.errs = append(g.errs, err.(*DirectiveError))
+		fmt.Fprintf(w, "<pre class=\"directive-error\">%s</pre>", html.EscapeString(err.Error()))
+		return nil
+	}
+	return err
+}
+
+// inline returns the HTML for an inline directive, the body of whose code
+// span is span. Its output is embedded like that of a directive, except that
+// a trailing newline is removed and text is not wrapped in a block. If its
+// command fails, the error is recorded and its text is written as code.
+func (g *Generator) inline(span string) string {
+	d := inlineDirective(span)
+	index := g.ndir
+	g.ndir++
+	code := "<code>" + html.EscapeString(d.Raw) + "</code>"
+	if g.DryRun {
+		return code
+	}
+	var b strings.Builder
+	out, typ, err := g.run(index, d)
+	if err == nil {
+		out = bytes.TrimSuffix(out, []byte("\n"))
+		if mt, _, _ := mime.ParseMediaType(typ); strings.HasPrefix(mt, "text/") && mt != "text/html" {
+			b.WriteString(html.EscapeString(string(out)))
+		} else if eerr := g.embed(index, typ, "", out, &b); eerr != nil {
+			derr := g.directiveError(index, d)
+			derr.Err = eerr
+			err = derr
+		}
+	}
+	switch {
+	case err == nil:
+		return b.String()
+	case g.ContinueOnError:
+		g.errs = append(g.errs, err.(*DirectiveError))
+		return fmt.Sprintf("<code class=\"directive-error\">%s</code>", html.EscapeString(err.Error()))
+	case g.inlineErr == nil:
+		g.inlineErr = err
+	}
+	return code
+}
+
+// inlineDirective returns the directive of an inline directive,
+// the body of whose code span is span.
+func inlineDirective(span string) *ast.Directive {
+	command, text, _ := ast.SplitInline(span)
+	return &ast.Directive{Command: command + "\n", Raw: text}
+}
+
+// figure reports whether d has attributes that describe a figure.
+func figure(d *ast.Directive) bool {
+	for _, name := range [...]string{"id", "class", "caption"} {
+		if _, ok := d.Attrs[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// embed writes the output of the index'th directive to w, according to its
+// media type. If typ is empty, the media type is determined by sniffing
+// the output, which is assumed to be HTML if it is text. Images are given
+// the alternate text alt, if any.
+func (g *Generator) embed(index int, typ, alt string, out []byte, w io.Writer) error {
+	if typ == "" {
+		typ = http.DetectContentType(out)
+		if strings.HasPrefix(typ, "text/") {
+			typ = "text/html"
+		}
+	}
+	if mt, _, err := mime.ParseMediaType(typ); err == nil {
+		typ = mt
+	}
+	switch {
+	case typ == "text/html", typ == "image/svg+xml":
+		w.Write(out)
+	case strings.HasPrefix(typ, "text/"):
+		fmt.Fprintf(w, "<pre>%s</pre>", html.EscapeString(string(out)))
+	default:
+		src, name, err := g.link(index, typ, out)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(typ, "image/") && alt != "" {
+			fmt.Fprintf(w, "<img src=\"%s\" alt=\"%s\">", html.EscapeString(src), html.EscapeString(alt))
+		} else if strings.HasPrefix(typ, "image/") {
+			fmt.Fprintf(w, "<img src=\"%s\">", html.EscapeString(src))
+		} else {
+			fmt.Fprintf(w, "<a href=\"%s\">%s</a>", html.EscapeString(src), html.EscapeString(name))
+		}
+	}
+	return nil
+}
+
+// link returns a URL referencing the output of the index'th directive, which
+// has media type typ, along with a file name for the output. The output is
+// embedded in a data URL, unless SideFiles is set, in which case it is
+// written to the named file in OutDir, which must be set.
+func (g *Generator) link(index int, typ string, out []byte) (url, name string, err error) {
+	name = g.name(index) + extension(typ)
+	if !g.SideFiles {
+		return "data:" + typ + ";base64," + base64.StdEncoding.EncodeToString(out), name, nil
+	}
+	if g.OutDir == "" {
+		return "", "", errors.New("no output directory for side files")
+	}
+	if err := ioutil.WriteFile(filepath.Join(g.OutDir, name), out, 0666); err != nil {
+		return "", "", err
+	}
+	return name, name, nil
+}
+
+// extensions maps common media types to their preferred file extension.
+var extensions = map[string]string{
+	"application/pdf": ".pdf",
+	"image/gif":       ".gif",
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/webp":      ".webp",
+}
+
+// extension returns the file extension for media type typ.
+func extension(typ string) string {
+	if ext, ok := extensions[typ]; ok {
+		return ext
+	}
+	if exts, _ := mime.ExtensionsByType(typ); len(exts) > 0 {
+		return exts[0]
+	}
+	return ".bin"
+}
+
+// options configure how the command of a directive is run.
+type options struct {
+	timeout time.Duration
+	retries int
+	typ     string // media type of the command's output
+	shell   string // shell used to interpret the command line
+}
+
+// attrOptions maps the attributes of a directive to
+// the variables that set the same options.
+var attrOptions = [...]struct{ attr, name string }{
+	{"timeout", "MEXDOWN_TIMEOUT"},
+	{"retries", "MEXDOWN_RETRIES"},
+	{"type", "MEXDOWN_TYPE"},
+	{"shell", "MEXDOWN_SHELL"},
+}
+
+// options returns the generator's options, overridden by any
+// MEXDOWN_* variables assigned in env, which are in turn
+// overridden by the attributes attrs.
+func (g *Generator) options(env []string, attrs map[string]string) (options, error) {
+	opt := options{timeout: g.Timeout, retries: g.Retries, shell: g.Shell}
+	env = env[:len(env):len(env)]
+	for _, o := range attrOptions {
+		if val, ok := attrs[o.attr]; ok {
+			env = append(env, o.name+"="+val)
+		}
+	}
+	var err error
+	for _, kv := range env {
+		i := strings.Index(kv, "=")
+		switch name, val := kv[:i], kv[i+1:]; name {
+		case "MEXDOWN_TIMEOUT":
+			opt.timeout, err = time.ParseDuration(val)
+		case "MEXDOWN_RETRIES":
+			opt.retries, err = strconv.Atoi(val)
+		case "MEXDOWN_TYPE":
+			opt.typ = val
+		case "MEXDOWN_SHELL":
+			opt.shell = val
+		}
+		if err != nil {
+			return opt, fmt.Errorf("invalid %s", kv)
+		}
+	}
+	return opt, nil
+}
+
+// assignments splits the leading variable assignments of the form
+// NAME=value from words.
+func assignments(words []string) (env, rest []string) {
+	for i, w := range words {
+		eq := strings.Index(w, "=")
+		if eq <= 0 || !isName(w[:eq]) {
+			return words[:i], words[i:]
+		}
+	}
+	return words, nil
+}
+
+// isName reports whether s is a valid shell variable name.
+func isName(s string) bool {
+	for i, r := range s {
+		switch {
+		case r == '_', 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z':
+		case '0' <= r && r <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return s != ""
+}
+
+// source returns the name of the file containing d, if known.
+func (g *Generator) source(d *ast.Directive) string {
+	if d.File != "" {
+		return d.File
+	}
+	return g.Source
+}
+
+// dir returns the working directory of the commands of d, which is the
+// directory of the file containing it, if known.
+func (g *Generator) dir(d *ast.Directive) string {
+	if s := g.source(d); s != "" {
+		return filepath.Dir(s)
+	}
+	return ""
+}
+
+// directiveError returns a *DirectiveError describing d, the index'th directive.
+func (g *Generator) directiveError(index int, d *ast.Directive) *DirectiveError {
+	return &DirectiveError{
+		Source:   g.source(d),
+		Line:     d.Line,
+		Index:    index,
+		Command:  strings.TrimSuffix(d.Command, "\n"),
+		ExitCode: -1,
+	}
+}
+
+// A Stage is a command in the pipeline of a directive.
+type Stage struct {
+	Env  []string // Variable assignments preceding the command
+	Args []string // Command and its arguments
+	Path string   // Resolved path of the command's executable, if known
+	Dir  string   // Working directory of the command, if not the current directory
+}
+
+// command splits the command line of d into the stages of its pipeline,
+// and returns the options in effect. If a shell is in effect, the whole
+// command line is interpreted by the shell in a single stage.
+func (g *Generator) command(d *ast.Directive) ([]Stage, options, error) {
+	line := strings.TrimSuffix(d.Command, "\n")
+	words, err := sq.Split(line)
+	if err != nil {
+		return nil, options{}, err
+	}
+	env, _ := assignments(words)
+	opt, err := g.options(env, d.Attrs)
+	if err != nil {
+		return nil, opt, err
+	}
+	if opt.shell != "" {
+		return []Stage{{Args: []string{opt.shell, "-c", line}, Dir: g.dir(d)}}, opt, nil
+	}
+	var stages []Stage
+	for i, cmd := range pipeline(line) {
+		words, err := sq.Split(cmd)
+		if err != nil {
+			return nil, opt, err
+		}
+		env, argv := assignments(words)
+		if len(argv) == 0 {
+			return nil, opt, errors.New("no valid commands")
+		}
+		if i == 0 {
+			env = withoutOptions(env)
+		}
+		stages = append(stages, Stage{Env: env, Args: argv, Dir: g.dir(d)})
+	}
+	return stages, opt, nil
+}
+
+// withoutOptions returns the assignments in env
+// that do not set an option of the generator.
+func withoutOptions(env []string) []string {
+	var rest []string
+	for _, kv := range env {
+		name := kv[:strings.Index(kv, "=")]
+		opt := false
+		for _, o := range attrOptions {
+			opt = opt || o.name == name
+		}
+		if !opt {
+			rest = append(rest, kv)
+		}
+	}
+	return rest
+}
+
+// pipeline splits line into the commands of a pipeline, which are
+// separated by vertical bars that are neither quoted nor escaped.
+func pipeline(line string) []string {
+	var (
+		cmds    []string
+		beg     int
+		quote   rune
+		escaped bool
+	)
+	for i, r := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '|':
+			cmds = append(cmds, line[beg:i])
+			beg = i + 1
+		}
+	}
+	return append(cmds, line[beg:])
+}
+
+// DirectiveInfo describes how the generator would process a directive.
+type DirectiveInfo struct {
+	Index    int     // Index of the directive among all directives in the file
+	Line     int     // Line number of the directive
+	File     string  // Name of the file containing the directive, if known
+	Command  string  // Command line of the directive
+	Stages   []Stage // Commands of the directive's pipeline
+	Run      bool    // Whether the command would be run
+	Replayed bool    // Whether the command's output would be replayed instead
+	Err      error   // Reason the command could not be run or replayed, if any
+}
+
+// Directives describes each directive in the file, including inline directives,
+// without running any commands. A directive without a command is reported as
+// not being run. If the generator replays a recording, commands are looked up
+// in the recording instead of PATH. The line of an inline directive is unknown.
+//
+// Directives are listed in the order that they would be run, which is the order
+// of their indexes: those in the file's statements first, followed by those in
+// its referenced footnotes, in the order that the footnotes are numbered.
+func (g *Generator) Directives() []DirectiveInfo {
+	var infos []DirectiveInfo
+	notes := make(map[string]*ast.Footnote)
+	ast.Inspect(g.file, func(n ast.Node) bool {
+		if fn, ok := n.(*ast.Footnote); ok {
+			if _, ok := notes[fn.Label]; !ok {
+				notes[fn.Label] = fn
+			}
+			return false
+		}
+		return true
+	})
+	var forder []string // labels of footnotes in order of first reference
+	numbered := make(map[string]bool)
+	text := func(t ast.Text) {
+		spans := append([]ast.Format(nil), t.Format...)
+		sort.Slice(spans, func(i, j int) bool { return spans[i].Beg < spans[j].Beg })
+		body := []rune(t.Body)
+		for _, f := range spans {
+			switch f.Kind {
+			case ast.InlineDirective:
+				d := inlineDirective(string(body[f.Beg+1 : f.End]))
+				infos = append(infos, g.info(len(infos), d))
+			case ast.FootnoteRef:
+				label := string(body[f.Beg+2 : f.End])
+				if _, ok := notes[label]; ok && !numbered[label] {
+					forder = append(forder, label)
+					numbered[label] = true
+				}
+			}
+		}
+	}
+	for _, st := range g.file.List {
+		ast.Inspect(st, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.Footnote:
+				return false
+			case *ast.Directive:
+				infos = append(infos, g.info(len(infos), n))
+				return false
+			case *ast.Paragraph:
+				text(ast.Text(*n))
+			case ast.Text:
+				text(n)
+			}
+			return true
+		})
+	}
+	// Footnotes may reference other footnotes, which are appended to forder.
+	for i := 0; i < len(forder); i++ {
+		text(notes[forder[i]].Text)
+	}
+	return infos
+}
+
+// info describes how the generator would process d, the index'th directive.
+func (g *Generator) info(index int, d *ast.Directive) DirectiveInfo {
+	info := DirectiveInfo{
+		Index:   index,
+		Line:    d.Line,
+		File:    g.source(d),
+		Command: strings.TrimSuffix(d.Command, "\n"),
+	}
+	if len(d.Command) != 0 {
+		info.Stages, _, info.Err = g.command(d)
+		switch {
+		case info.Err != nil:
+		case g.Replay != nil:
+			_, info.Err = g.Replay.lookup(d)
+			info.Replayed = info.Err == nil
+		default:
+			for i := range info.Stages {
+				st := &info.Stages[i]
+				if st.Path, info.Err = lookPath(st); info.Err != nil {
+					break
+				}
+			}
+			info.Run = info.Err == nil
+		}
+	}
+	return info
+}
+
+// lookPath searches for the executable of st, as it would be
+// resolved when run for a directive.
+func lookPath(st *Stage) (string, error) {
+	name := st.Args[0]
+	if strings.Contains(name, string(filepath.Separator)) && !filepath.IsAbs(name) {
+		name = filepath.Join(st.Dir, name)
+	}
+	return exec.LookPath(name)
+}
+
+// run executes the command of d, the index'th directive, and returns its
+// standard output along with its media type, if specified. A failed command
+// is retried according to the options in effect. Any error returned is of
+// type *DirectiveError.
+func (g *Generator) run(index int, d *ast.Directive) ([]byte, string, error) {
+	derr := g.directiveError(index, d)
+	stages, opt, err := g.command(d)
+	if err != nil {
+		derr.Err = err
+		return nil, "", derr
+	}
+	scratch, err := ioutil.TempDir("", "mexdown")
+	if err != nil {
+		derr.Err = err
+		return nil, "", derr
+	}
+	defer os.RemoveAll(scratch)
+	env := g.environ(index, d, scratch)
+	var out []byte
+	if g.Replay != nil {
+		out, err = g.Replay.replay(d, scratch, g.Stderr, derr)
+	} else {
+		var stderr bytes.Buffer
+		out, err = g.retry(stages, env, d.Raw, opt, scratch, &stderr, derr)
+		if g.Record != nil {
+			if rerr := g.Record.record(d, out, stderr.Bytes(), err, scratch); rerr != nil && err == nil {
+				derr.Err = rerr
+				err = derr
+			}
+		}
+	}
+	if err != nil {
+		return out, "", err
+	}
+	if err := g.collect(index, scratch); err != nil {
+		derr.Err = err
+		return out, "", derr
+	}
+	return out, opt.typ, nil
+}
+
+// retry runs the pipeline of stages in the environment env until it succeeds,
+// or until it has been retried as many times as opt allows. The standard
+// error of the last attempt is written to stderr. The scratch directory is
+// emptied before each attempt, so that it only holds the files of the last.
+func (g *Generator) retry(stages []Stage, env []string, stdin string, opt options, scratch string, stderr *bytes.Buffer, derr *DirectiveError) ([]byte, error) {
+	delay := g.RetryDelay
+	for {
+		derr.Attempts++
+		stderr.Reset()
+		if err := emptyDir(scratch); err != nil {
+			derr.Err = err
+			return nil, derr
+		}
+		out, err := g.attempt(stages, env, stdin, opt.timeout, stderr, derr)
+		if err == nil {
+			return out, nil
+		}
+		if derr.Attempts > opt.retries || g.ctx.Err() != nil {
+			return out, derr
+		}
+		select {
+		case <-g.ctx.Done():
+			return out, derr
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// attempt runs the pipeline of stages once in the environment env, with
+// the standard output of each stage connected to the standard input of the
+// next. The standard error of every stage is copied to stderr. If the
+// pipeline fails, the details of its rightmost failed stage are recorded
+// in derr.
+func (g *Generator) attempt(stages []Stage, env []string, stdin string, timeout time.Duration, stderr io.Writer, derr *DirectiveError) ([]byte, error) {
+	ctx, cancel := context.WithCancel(g.ctx)
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(g.ctx, timeout)
+	}
+	defer cancel()
+	var out bytes.Buffer
+	tail := &tailWriter{max: stderrTail}
+	errw := &syncWriter{w: io.MultiWriter(g.Stderr, tail, stderr)}
+	cmds := make([]*exec.Cmd, len(stages))
+	for i, st := range stages {
+		cmd := exec.CommandContext(ctx, st.Args[0], st.Args[1:]...)
+		cmd.Dir = st.Dir
+		cmd.Env = append(append([]string(nil), env...), st.Env...)
+		cmd.Stderr = errw
+		cmds[i] = cmd
+	}
+	cmds[0].Stdin = strings.NewReader(stdin)
+	cmds[len(cmds)-1].Stdout = &out
+	err := runPipeline(cmds, cancel)
+	if err == nil {
+		return out.Bytes(), nil
+	}
+	derr.Err = err
+	derr.Stderr = tail.b
+	derr.ExitCode = -1
+	derr.TimedOut = false
+	if ee, ok := err.(*exec.ExitError); ok {
+		derr.ExitCode = ee.ExitCode()
+	}
+	if ctx.Err() == context.DeadlineExceeded && g.ctx.Err() == nil {
+		derr.Err = fmt.Errorf("timed out after %v", timeout)
+		derr.TimedOut = true
+	}
+	return out.Bytes(), derr
+}
+
+// runPipeline starts cmds with the standard output of each connected to the
+// standard input of the next, and waits for all of them to exit. If a
+// command cannot be started, cancel is called to stop the commands that
+// were. It returns the error of the rightmost command that failed, except
+// that, as in the shell, a command other than the last one that is killed
+// by SIGPIPE, because a later command stopped reading, has not failed.
+func runPipeline(cmds []*exec.Cmd, cancel context.CancelFunc) error {
+	var pipes []io.Closer
+	defer func() {
+		for _, p := range pipes {
+			p.Close()
+		}
+	}()
+	for i := 0; i < len(cmds)-1; i++ {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		pipes = append(pipes, r, w)
+		cmds[i].Stdout = w
+		cmds[i+1].Stdin = r
+	}
+	var err error
+	started := 0
+	for _, cmd := range cmds {
+		if err = cmd.Start(); err != nil {
+			cancel()
+			break
+		}
+		started++
+	}
+	// The started commands hold their own copies of the pipes.
+	for _, p := range pipes {
+		p.Close()
+	}
+	pipes = nil
+	for i := started - 1; i >= 0; i-- {
+		werr := cmds[i].Wait()
+		if werr != nil && err == nil && !(i < len(cmds)-1 && brokenPipe(werr)) {
+			err = werr
+		}
+	}
+	return err
+}
+
+// brokenPipe reports whether err is that of a command killed by SIGPIPE.
+func brokenPipe(err error) bool {
+	ee, ok := err.(*exec.ExitError)
+	if !ok {
+		return false
+	}
+	ws, ok := ee.Sys().(syscall.WaitStatus)
+	return ok && ws.Signaled() && ws.Signal() == syscall.SIGPIPE
+}
+
+// An Artifact is a file produced by a directive's command.
+type Artifact struct {
+	Index int    // Index of the directive that produced the file
+	Name  string // Slash-separated path of the file within the directive's artifacts
+	Path  string // Path of the collected file
+}
+
+// collect copies any files in the scratch directory of the index'th
+// directive into its artifact directory in OutDir, which must be set
+// if there are any.
+func (g *Generator) collect(index int, scratch string) error {
+	dir := filepath.Join(g.OutDir, g.name(index))
+	return filepath.Walk(scratch, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		if g.OutDir == "" {
+			return errors.New("no output directory for artifacts")
+		}
+		rel, err := filepath.Rel(scratch, path)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+			return err
+		}
+		if err := copyFile(dst, path); err != nil {
+			return err
+		}
+		g.artifacts = append(g.artifacts, Artifact{
+			Index: index,
+			Name:  filepath.ToSlash(rel),
+			Path:  dst,
+		})
+		return nil
+	})
+}
+
+// emptyDir removes the contents of dir.
+func emptyDir(dir string) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if err := os.RemoveAll(filepath.Join(dir, info.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(dst, src string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// name returns the name under which files produced for the index'th
+// directive are written to OutDir.
+func (g *Generator) name(index int) string {
+	name := "directive"
+	if g.Source != "" {
+		name = strings.TrimSuffix(filepath.Base(g.Source), filepath.Ext(g.Source))
+	}
+	return name + "-" + strconv.Itoa(index)
+}
+
+// environ returns the environment for the command of d, the index'th directive,
+// whose scratch directory for artifacts is scratch. Later entries take
+// precedence over earlier ones.
+func (g *Generator) environ(index int, d *ast.Directive, scratch string) []string {
+	env := append(os.Environ(),
+		"MEXDOWN_BACKEND=html",
+		"MEXDOWN_SOURCE="+abs(g.source(d)),
+		"MEXDOWN_DIRECTIVE_INDEX="+strconv.Itoa(index),
+		"MEXDOWN_OUTDIR="+abs(g.OutDir),
+		"MEXDOWN_ARTIFACTS="+scratch,
+		"MEXDOWN_ARTIFACTS_URL="+g.name(index)+"/",
+	)
+	return append(g.metaEnviron(env), g.Env...)
+}
+
+// metaEnviron appends a variable for each key of the front matter to env,
+// in sorted order.
+func (g *Generator) metaEnviron(env []string) []string {
+	keys := make([]string, 0, len(g.file.Meta))
+	for key := range g.file.Meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		env = append(env, "MEXDOWN_META_"+metaName(key)+"="+g.file.Meta[key])
+	}
+	return env
+}
+
+// metaName converts the front matter key to the suffix of its variable name,
+// by converting it to upper case and replacing other characters that are not
+// valid in a variable name with underscores.
+func metaName(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z':
+			return r - 'a' + 'A'
+		case 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+}
+
+// abs is like filepath.Abs, but returns the empty string for an empty path
+// and the path itself if it cannot be made absolute.
+func abs(path string) string {
+	if path == "" {
+		return ""
+	}
+	if a, err := filepath.Abs(path); err == nil {
+		return a
+	}
+	return path
+}
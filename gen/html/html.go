@@ -25,14 +25,93 @@
 // Overlapping format tags in the source are converted into a tree structure.
 // Directives are parsed according to the Bourne shell's word-splitting rules.
 //
+// A directive's command is run in the directory of the file containing it, which is
+// the generator's Source file unless the directive was included from another file,
+// with the generator's environment extended by the following variables:
+// 	MEXDOWN_BACKEND             The name of the backend, "html"
+// 	MEXDOWN_SOURCE              The absolute path of the file containing the directive, if known
+// 	MEXDOWN_DIRECTIVE_INDEX     The index of the directive among all directives in the file
+// 	MEXDOWN_OUTDIR              The absolute path of the output directory, if known
+// 	MEXDOWN_ARTIFACTS           The absolute path of a scratch directory for artifacts
+// 	MEXDOWN_ARTIFACTS_URL       The URL of the artifacts, relative to the output directory
+// 	MEXDOWN_META_<KEY>          The value of each key in the file's front matter, such as
+// 	                            MEXDOWN_META_TITLE, with the key in upper case and other
+// 	                            characters replaced by underscores
+// Entries in the generator's Env field are applied last, and may override any of these.
+//
+// Files that a directive's command writes to its scratch directory are collected as
+// artifacts once the command succeeds, and copied into a directory in OutDir named after
+// the source file and the directive's index, such as "graphs-3/". The command's output
+// can reference them through MEXDOWN_ARTIFACTS_URL. A directive that leaves artifacts
+// fails if OutDir is empty.
+//
+// As in the Bourne shell, a directive's command may be preceded by variable
+// assignments of the form NAME=value, which are added to the command's environment.
+// The following variables instead override the generator's settings for that directive,
+// and are not added to its environment:
+// 	MEXDOWN_TIMEOUT             The command's timeout, as accepted by time.ParseDuration
+// 	MEXDOWN_RETRIES             The number of times to retry the command if it fails
+// 	MEXDOWN_TYPE                The media type of the command's output
+// 	MEXDOWN_SHELL               The shell used to interpret the command line
+// For example,
+// 	```MEXDOWN_TIMEOUT=30s MEXDOWN_RETRIES=2 plantuml -tsvg -p
+//
+// A command line may also be a pipeline of commands separated by vertical bars '|',
+// such as `m4 | dot -Tsvg`. Each command is run with its standard input connected
+// to the standard output of the previous command, and the pipeline fails if any of
+// its commands fail. As in the shell, a command killed by SIGPIPE because a later
+// command stopped reading, as in `yes | head -1`, has not failed. Variable
+// assignments apply to the command they precede, but only those preceding the first
+// command override the generator's settings.
+// Other shell syntax is only supported when a shell is set.
+//
+// If a command's media type is not specified, it is sniffed from its output,
+// and text is assumed to be HTML.
+//
+// The attributes of a directive, given in braces after its opening backticks,
+// are not passed to its command. The attributes timeout, retries, type, and shell
+// set the same options as the variables above, and take precedence over them.
+// A directive with an id, class, or caption attribute is wrapped in a figure,
+// and the alt attribute sets the alternate text of an image. For example,
+// 	```{id=flow caption="Request flow" alt="Flow chart"} dot -Tpng
+//
+// An inline directive, such as `!{git describe}v0`, is run like a directive and
+// counted among them, with the text after its command as standard input. Its
+// output replaces the code span with a trailing newline removed, and text of a
+// media type other than HTML is escaped rather than wrapped in a block. If its
+// command fails, generation stops after the statement containing it, unless
+// ContinueOnError is set.
+//
 // AST nodes correspond to the following HTML tags:
 // 	Paragraph                   <p></p>
 // 	Header                      <h1></h1>, <h2></h2>, <h3></h3>, <h4></h4>, <h5></h5>, <h6></h6>, <p></p>
-// 	List                        <ul></ul>
+// 	List                        <ul></ul>, <ol start=""></ol> for numbered items
 // 	ListItem (bulleted)         <li class="bullet"></li>
 // 	ListItem (labeled)          <li><span></span></li>
+// 	ListItem (numbered)         <li></li>
+// 	ListItem (task)             <li class="task"><input type="checkbox" checked disabled></li>,
+// 	                            without checked if the task is open
+// 	List (definitions)          <dl><dt></dt><dd></dd></dl>, if DefinitionLists is set and the
+// 	                            list's items are all labeled and none are numbered, indented,
+// 	                            or tasks
 // 	Directive (raw string)      <pre></pre>
-// 	Directive (with command)    Depends on the result of command execution
+// 	Directive (with command)    Depends on the media type of the command's output:
+// 	    text/html                   Written as is
+// 	    image/svg+xml               Written as is
+// 	    text/*                      <pre></pre>
+// 	    image/*                     <img src="" alt="">
+// 	    Other                       <a href=""></a>
+// 	Directive (failed)          <pre class="directive-error"></pre>, if ContinueOnError is set
+// 	Directive (figure)          <figure id="" class=""><figcaption></figcaption></figure>, around the above
+// 	Quote                       <blockquote></blockquote>
+// 	Rule                        <hr>
+// 	Comment                     Not written
+// 	PageBreak                   <hr class="page-break" style="break-after: page">, which
+// 	                            starts a new page when printed
+// 	Table                       <table><thead></thead><tbody></tbody></table>
+// 	TableRow                    <tr></tr>
+// 	TableCell                   <th></th> in the header, otherwise <td></td>, with a
+// 	                            style attribute setting text-align if its column is aligned
 // 	Citation                    <a href=""></a>
 // 	Italics                     <em></em>
 // 	Bold                        <strong></strong>
@@ -40,6 +119,20 @@
 // 	Underline                   <u></u>
 // 	Strikethrough               <s></s>
 // 	Code Segment                <code></code>
+// 	Line break                  <br>, in place of the backslash or spaces before the newline
+// 	Inline directive            Like a directive, with text/* other than HTML escaped;
+// 	                            <code></code> for its text if DryRun is set or it fails,
+// 	                            <code class="directive-error"></code> if ContinueOnError is set
+// 	Image                       <img src="" alt="">
+// 	Math                        <span class="math inline">\(\)</span>, unless converted
+// 	DisplayMath                 <span class="math display">\[\]</span>, unless converted
+// 	Footnote reference          <sup class="footnote-ref"><a href="#fn-1" id="fnref-1"></a></sup>
+// 	Footnote                    <li id="fn-1"><a href="#fnref-1" class="footnote-backref"></a></li>,
+// 	                            in a <section class="footnotes"><ol></ol></section> after the file
+//
+// Footnotes are numbered in the order that they are first referenced. A warning is
+// written to Stderr for each reference to an undefined footnote, and for each footnote
+// that is defined more than once or never referenced.
 package html // import "akhil.cc/mexdown/gen/html"
 
 import (
@@ -47,16 +140,17 @@ import (
 	"context"
 	"fmt"
 	"html"
+	"html/template"
 	"io"
 	"io/ioutil"
-	"os/exec"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
+	"unicode/utf8"
 
 	"akhil.cc/mexdown/ast"
-	sq "github.com/kballard/go-shellquote"
 )
 
 type syncWriter struct {
@@ -95,11 +189,114 @@ type Generator struct {
 	// written by a process run for an *ast.Directive.
 	//
 	// If Stdout == Stderr, at most one goroutine at a time will call Write.
-	Stdout   io.Writer
-	Stderr   io.Writer
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// Source is the name of the file the AST was parsed from. If non-empty,
+	// commands run for an *ast.Directive use its directory as their
+	// working directory, unless the directive records its own File.
+	Source string
+
+	// OutDir is the directory that HTML output is being written to.
+	// It is passed to directive commands as MEXDOWN_OUTDIR.
+	OutDir string
+
+	// SideFiles causes images and other binary output of directives
+	// to be written to files in OutDir and linked, instead of being
+	// embedded as data URLs. A directive whose output would be written
+	// to a side file fails if OutDir is empty.
+	SideFiles bool
+
+	// Env specifies additional environment entries for directive commands,
+	// each of the form "key=value". They take precedence over both the
+	// generator's environment and the MEXDOWN_* variables.
+	Env []string
+
+	// Shell is the path of a shell, such as "sh", used to interpret the
+	// command lines of directives. If set, each command line is run as
+	// `Shell -c line`, instead of as a pipeline by the generator.
+	Shell string
+
+	// DryRun prevents directive commands from being run. Instead, their raw
+	// strings are written as if they had no command. Use the Directives
+	// method to inspect the commands that would be run. Neither is the
+	// MathCommand run, so that math is written as markup.
+	DryRun bool
+
+	// If Record is non-nil, the results of directive commands are added to it.
+	// Record is not used when Replay is non-nil, as no commands are run.
+	Record *Recording
+
+	// If Replay is non-nil, directive commands are not run. Instead, their
+	// results are replayed from the recording, and a directive fails if its
+	// command and raw string were not recorded.
+	Replay *Recording
+
+	// ContinueOnError causes the error of a failed directive to be rendered
+	// in place of its output, instead of halting generation. Once generation
+	// completes, the errors of all failed directives are returned as
+	// DirectiveErrors. Math that cannot be converted is then reported as a
+	// warning on Stderr instead of failing generation.
+	ContinueOnError bool
+
+	// Timeout limits the running time of each directive's command.
+	// If zero, a command is only limited by the generator's context.
+	Timeout time.Duration
+
+	// Retries is the number of times a failed directive's command is run
+	// again before its failure is reported. The first retry is delayed by
+	// RetryDelay, and each subsequent retry by twice the previous delay.
+	// Gen sets RetryDelay to one second.
+	Retries    int
+	RetryDelay time.Duration
+
+	// Math converts the TeX source of math to HTML, such as MathML. Display
+	// reports whether the math is displayed in a block of its own. If Math is
+	// nil and MathCommand is empty, math is written as markup for KaTeX's
+	// auto-render extension, such as <span class="math inline">\(x\)</span>.
+	Math func(tex string, display bool) (string, error)
+
+	// MathCommand is a command line, split like that of a directive, that
+	// converts the TeX source of math on its standard input to HTML on its
+	// standard output, when Math is nil. Its environment is that of a
+	// directive's command, without the variables that describe a directive,
+	// and MEXDOWN_MATH_DISPLAY is set to 1 for display math, and 0 otherwise.
+	// Its output for each distinct source is cached for the lifetime of the
+	// generator. It is not run if DryRun is set, and its results are recorded
+	// and replayed like those of a directive whose command line is preceded
+	// by the assignment to MEXDOWN_MATH_DISPLAY, and whose raw string is the
+	// TeX source.
+	MathCommand string
+
+	// DefinitionLists causes a list whose items are all labeled, and none of
+	// which are numbered, indented, or tasks, to be written as a definition
+	// list, with each label as a term and the text following it as the
+	// term's definition.
+	DefinitionLists bool
+
+	// If Template is non-nil, the generated HTML is not written to Stdout
+	// directly. Instead, Template is executed with a Page holding the HTML
+	// and the file's metadata, and its output is written to Stdout.
+	Template *template.Template
+
 	ctx      context.Context
 	file     *ast.File
 	waitdone chan error
+	ndir     int // number of directives processed
+	errs     DirectiveErrors
+
+	inlineErr error // error of the first inline directive that failed
+
+	artifacts []Artifact
+
+	notes  map[string]*ast.Footnote // footnotes by label
+	defs   []string                 // labels of footnotes in order of definition
+	fnum   map[string]int           // numbers of referenced footnotes by label
+	forder []string                 // labels of footnotes in order of first reference
+	nrefs  map[string]int           // number of references to each footnote
+
+	mathCache map[mathKey]string
+	mathErr   error // first error converting math
 
 	m     sync.Mutex
 	pipes []io.Closer
@@ -107,9 +304,9 @@ type Generator struct {
 
 // Gen returns the Generator struct to convert the given file into HTML output.
 //
-// It sets only the file in the returned structure.
+// It sets only the file and the default RetryDelay in the returned structure.
 func Gen(file *ast.File) *Generator {
-	return &Generator{ctx: context.TODO(), file: file}
+	return GenContext(context.TODO(), file)
 }
 
 // GenContext is like Gen but includes a context.
@@ -121,7 +318,7 @@ func GenContext(ctx context.Context, file *ast.File) *Generator {
 	if ctx == nil {
 		panic("nil context")
 	}
-	return &Generator{ctx: ctx, file: file}
+	return &Generator{ctx: ctx, file: file, RetryDelay: time.Second}
 }
 
 // Start starts the generator but does not wait for it to complete.
@@ -171,6 +368,12 @@ func (g *Generator) Wait() error {
 	return err
 }
 
+// Artifacts returns the artifacts collected from directive commands.
+// It is only valid to call Artifacts after Wait has returned.
+func (g *Generator) Artifacts() []Artifact {
+	return g.artifacts
+}
+
 // Run starts the generator and waits for it to complete, returning
 // any errors enountered.
 func (g *Generator) Run() error {
@@ -237,56 +440,195 @@ func (g *Generator) CombinedOutput() ([]byte, error) {
 	return b.Bytes(), err
 }
 
+// A Page is the data passed to a generator's Template.
+type Page struct {
+	Meta map[string]string // Metadata from the file's front matter
+	Body template.HTML     // Generated HTML of the file's statements
+}
+
 func (g *Generator) gen() error {
-	cw := &stickyCountWriter{0, nil, g.Stdout}
-	for i := range g.file.List {
+	if g.Template == nil {
+		return g.body(g.Stdout)
+	}
+	var buf bytes.Buffer
+	err := g.body(&buf)
+	if _, ok := err.(DirectiveErrors); err != nil && !ok {
+		return err
+	}
+	page := Page{Meta: g.file.Meta, Body: template.HTML(buf.String())}
+	if terr := g.Template.Execute(g.Stdout, page); terr != nil {
+		return terr
+	}
+	return err
+}
+
+// body writes the HTML of the file's statements to w,
+// followed by its footnotes.
+func (g *Generator) body(w io.Writer) error {
+	cw := &stickyCountWriter{0, nil, w}
+	g.defineFootnotes()
+	if err := g.stmts(g.file.List, cw); err != nil {
+		return err
+	}
+	g.footnotes(cw)
+	return g.result(cw)
+}
+
+// stmts writes the HTML of list to w, stopping early
+// if the generator's context is done.
+func (g *Generator) stmts(list []ast.Stmt, w io.Writer) error {
+	for _, st := range list {
 		select {
 		case <-g.ctx.Done():
-			return cw.err
+			return nil
 		default:
-			switch t := g.file.List[i].(type) {
-			case *ast.Paragraph:
-				if len(t.Body) != 0 {
-					cw.Write([]byte("<p>"))
-					txt := ast.Text(*t)
-					g.text(&txt, cw)
-					cw.Write([]byte("</p>"))
-				}
-			case *ast.Header:
-				var tag string
-				if t.NThorpe > 6 {
-					tag = "p"
-				} else {
-					tag = "h" + strconv.Itoa(t.NThorpe)
-				}
-				cw.Write([]byte("<" + tag + ">"))
-				g.text(&t.Text, cw)
-				cw.Write([]byte("</" + tag + ">"))
-			case *ast.List:
-				g.list(t, cw)
-			case *ast.Directive:
-				if len(t.Command) == 0 {
-					fmt.Fprintf(cw, "<pre>%s</pre>", html.EscapeString(t.Raw))
-				} else {
-					words, err := sq.Split(t.Command)
-					if err != nil {
-						return err
-					}
-					if len(words) == 0 {
-						return fmt.Errorf("No valid commands: '%q'", t.Command)
-					}
-					cmd := exec.CommandContext(g.ctx, words[0], words[1:]...)
-					cmd.Stdin = strings.NewReader(t.Raw)
-					cmd.Stdout = cw
-					cmd.Stderr = g.Stderr
-					if err := cmd.Run(); err != nil {
-						return err
-					}
-				}
+			if err := g.stmt(st, w); err != nil {
+				return err
+			}
+			if g.inlineErr != nil {
+				return g.inlineErr
+			}
+		}
+	}
+	return nil
+}
+
+func (g *Generator) stmt(st ast.Stmt, w io.Writer) error {
+	switch t := st.(type) {
+	case *ast.Paragraph:
+		if len(t.Body) != 0 {
+			w.Write([]byte("<p>"))
+			txt := ast.Text(*t)
+			g.text(&txt, w)
+			w.Write([]byte("</p>"))
+		}
+	case *ast.Header:
+		var tag string
+		if t.NThorpe > 6 {
+			tag = "p"
+		} else {
+			tag = "h" + strconv.Itoa(t.NThorpe)
+		}
+		w.Write([]byte("<" + tag + ">"))
+		g.text(&t.Text, w)
+		w.Write([]byte("</" + tag + ">"))
+	case *ast.List:
+		g.list(t, w)
+	case *ast.Table:
+		g.table(t, w)
+	case *ast.Quote:
+		w.Write([]byte("<blockquote>"))
+		if err := g.stmts(t.List, w); err != nil {
+			return err
+		}
+		w.Write([]byte("</blockquote>"))
+	case *ast.Rule:
+		w.Write([]byte("<hr>"))
+	case *ast.PageBreak:
+		w.Write([]byte("<hr class=\"page-break\" style=\"break-after: page\">"))
+	case *ast.Directive:
+		return g.directive(t, w)
+	case *ast.Comment:
+		// Comments are not part of the document.
+	}
+	return nil
+}
+
+// footnoteRef returns the HTML of a reference to the footnote with the given
+// label, numbering the footnote if this is its first reference. The reference
+// is written as span if the footnote is not defined.
+func (g *Generator) footnoteRef(label, span string) string {
+	if _, ok := g.notes[label]; !ok {
+		g.warnf("footnote [^%s] is not defined", label)
+		return span
+	}
+	n, ok := g.fnum[label]
+	if !ok {
+		g.forder = append(g.forder, label)
+		n = len(g.forder)
+		g.fnum[label] = n
+	}
+	g.nrefs[label]++
+	return fmt.Sprintf(fstr[footnote], n, refID(n, g.nrefs[label]), n)
+}
+
+// refID returns the id of the k'th reference to the n'th footnote.
+func refID(n, k int) string {
+	if k == 1 {
+		return fmt.Sprintf("fnref-%d", n)
+	}
+	return fmt.Sprintf("fnref-%d-%d", n, k)
+}
+
+// defineFootnotes collects the footnotes defined in the file.
+func (g *Generator) defineFootnotes() {
+	g.notes = make(map[string]*ast.Footnote)
+	g.fnum = make(map[string]int)
+	g.nrefs = make(map[string]int)
+	ast.Inspect(g.file, func(n ast.Node) bool {
+		fn, ok := n.(*ast.Footnote)
+		if !ok {
+			return true
+		}
+		if _, ok := g.notes[fn.Label]; ok {
+			g.warnf("footnote [^%s] is defined more than once", fn.Label)
+			return false
+		}
+		g.notes[fn.Label] = fn
+		g.defs = append(g.defs, fn.Label)
+		return false
+	})
+}
+
+// footnotes writes the footnotes that were referenced to w, in the order
+// of their first reference, each followed by links back to its references.
+func (g *Generator) footnotes(w io.Writer) {
+	if len(g.forder) > 0 {
+		w.Write([]byte("<section class=\"footnotes\"><ol>"))
+		// Footnotes may reference other footnotes, which are appended to forder.
+		for i := 0; i < len(g.forder); i++ {
+			label := g.forder[i]
+			fmt.Fprintf(w, "<li id=\"fn-%d\">", i+1)
+			txt := g.notes[label].Text
+			txt.Format = append([]ast.Format(nil), txt.Format...)
+			g.text(&txt, w)
+			for k := 1; k <= g.nrefs[label]; k++ {
+				fmt.Fprintf(w, " <a href=\"#%s\" class=\"footnote-backref\">&#8617;</a>", refID(i+1, k))
 			}
+			w.Write([]byte("</li>"))
+		}
+		w.Write([]byte("</ol></section>"))
+	}
+	for _, label := range g.defs {
+		if _, ok := g.fnum[label]; !ok {
+			g.warnf("footnote [^%s] is defined but not referenced", label)
 		}
 	}
-	return cw.err
+}
+
+// warnf writes a warning about the source to the generator's standard error.
+func (g *Generator) warnf(format string, args ...interface{}) {
+	if g.Source != "" {
+		fmt.Fprintf(g.Stderr, "%s: ", g.Source)
+	}
+	fmt.Fprintf(g.Stderr, "warning: "+format+"\n", args...)
+}
+
+// result returns the error to report once generation has stopped.
+func (g *Generator) result(cw *stickyCountWriter) error {
+	if cw.err != nil {
+		return cw.err
+	}
+	if g.inlineErr != nil {
+		return g.inlineErr
+	}
+	if g.mathErr != nil {
+		return g.mathErr
+	}
+	if len(g.errs) > 0 {
+		return g.errs
+	}
+	return nil
 }
 
 func replace(s, r string, pos, width int) string {
@@ -294,6 +636,11 @@ func replace(s, r string, pos, width int) string {
 	return string(rs[:pos]) + r + string(rs[pos+width:])
 }
 
+// substr returns the width runes of s starting at the rune index pos.
+func substr(s string, pos, width int) string {
+	return string([]rune(s)[pos : pos+width])
+}
+
 func open(tag int) bool {
 	return tag&1 == 0
 }
@@ -313,6 +660,16 @@ const (
 	strikethroughClose
 	code
 	codeClose
+	image
+	imageClose
+	footnote
+	footnoteClose
+	math
+	mathClose
+	inline
+	inlineClose
+	lineBreak
+	lineBreakClose
 )
 
 var fstr = [...]string{
@@ -330,6 +687,16 @@ var fstr = [...]string{
 	strikethroughClose: "</s>",
 	code:               "<code>",
 	codeClose:          "</code>",
+	image:              "<img src=\"%s\" alt=\"%s\">",
+	imageClose:         "",
+	footnote:           "<sup class=\"footnote-ref\"><a href=\"#fn-%d\" id=\"%s\">%d</a></sup>",
+	footnoteClose:      "",
+	math:               "",
+	mathClose:          "",
+	inline:             "",
+	inlineClose:        "",
+	lineBreak:          "<br>",
+	lineBreakClose:     "",
 }
 
 func (g *Generator) text(t *ast.Text, w io.Writer) (n int, err error) {
@@ -372,8 +739,51 @@ func (g *Generator) text(t *ast.Text, w io.Writer) (n int, err error) {
 			}
 		}
 	}
+	// Formats inside the alternate text of an image, the label
+	// of a footnote reference, math, or an inline directive, are ignored.
+	inSpan := func(f ast.Format) bool {
+		for _, sp := range t.Format {
+			switch sp.Kind {
+			case ast.Image, ast.FootnoteRef, ast.Math, ast.DisplayMath, ast.InlineDirective:
+			default:
+				continue
+			}
+			if f != sp && sp.Beg <= f.Beg && f.End <= sp.End {
+				return true
+			}
+		}
+		return false
+	}
 	for _, f := range t.Format {
+		if inSpan(f) {
+			continue
+		}
 		switch f.Kind {
+		case ast.Image:
+			// The image replaces its whole span, so its closing tag is empty.
+			rep = append(rep, repl{f.Beg, f.End - f.Beg + 1, image, 0})
+			rep = append(rep, repl{f.End, 0, imageClose, 0})
+		case ast.FootnoteRef:
+			rep = append(rep, repl{f.Beg, f.End - f.Beg + 1, footnote, 0})
+			rep = append(rep, repl{f.End, 0, footnoteClose, 0})
+		case ast.Math, ast.DisplayMath:
+			// The positions of math are those of the last character of
+			// each delimiter, and extra holds the delimiter's width.
+			dw := 1
+			if f.Kind == ast.DisplayMath {
+				dw = 2
+			}
+			beg := f.Beg - dw + 1
+			rep = append(rep, repl{beg, f.End - beg + 1, math, dw})
+			rep = append(rep, repl{f.End, 0, mathClose, 0})
+		case ast.InlineDirective:
+			rep = append(rep, repl{f.Beg, f.End - f.Beg + 1, inline, 0})
+			rep = append(rep, repl{f.End, 0, inlineClose, 0})
+		case ast.LineBreak:
+			// The break replaces its marker, and its closing tag is placed
+			// at the newline following it, so that the two are never reordered.
+			rep = append(rep, repl{f.Beg, f.End - f.Beg + 1, lineBreak, 0})
+			rep = append(rep, repl{f.End + 1, 0, lineBreakClose, 0})
 		case ast.Cite:
 			rep = append(rep, repl{f.Beg, f.End, anchor, 0})
 			begClose := f.Beg
@@ -410,7 +820,7 @@ func (g *Generator) text(t *ast.Text, w io.Writer) (n int, err error) {
 			// Walk backwards through list
 			for lower := current - 1; lower >= bottom; lower-- {
 				// Find first opening tag that does not match closing
-				if rep[lower].kind != anchor && open(rep[lower].kind) && (rep[current].kind-rep[lower].kind) != 1 {
+				if rep[lower].kind != anchor && rep[lower].kind != image && rep[lower].kind != footnote && rep[lower].kind != math && rep[lower].kind != inline && rep[lower].kind != lineBreak && open(rep[lower].kind) && (rep[current].kind-rep[lower].kind) != 1 {
 					rlower := rep[lower]
 					rcurr := rep[current]
 					// Insert its closing tag before our unmatched tag
@@ -440,6 +850,40 @@ func (g *Generator) text(t *ast.Text, w io.Writer) (n int, err error) {
 			}
 			t.Body = replace(t.Body, citation, f.i+offset, 1)
 			offset += len(citation) - 1
+		case image:
+			// ![src] or ![alt](src), where src may be a citation's label.
+			span := substr(t.Body, f.i+offset, f.w)
+			alt, src := "", span[2:len(span)-1]
+			if del := strings.Index(span, "]("); del >= 0 && span[len(span)-1] == ')' {
+				alt, src = span[2:del], span[del+2:len(span)-1]
+				if hSrc, ok := g.file.Cite[src]; ok {
+					src = strings.TrimSpace(hSrc)
+				}
+			}
+			img := fmt.Sprintf(fstr[f.kind], html.EscapeString(src), html.EscapeString(alt))
+			t.Body = replace(t.Body, img, f.i+offset, f.w)
+			offset += utf8.RuneCountInString(img) - f.w
+		case footnote:
+			// [^label]
+			span := substr(t.Body, f.i+offset, f.w)
+			ref := g.footnoteRef(span[2:len(span)-1], span)
+			t.Body = replace(t.Body, ref, f.i+offset, f.w)
+			offset += utf8.RuneCountInString(ref) - f.w
+		case math:
+			span := substr(t.Body, f.i+offset, f.w)
+			m := g.math(span[f.extra:len(span)-f.extra], f.extra == 2)
+			t.Body = replace(t.Body, m, f.i+offset, f.w)
+			offset += utf8.RuneCountInString(m) - f.w
+		case inline:
+			// `!{command}text`
+			span := substr(t.Body, f.i+offset, f.w)
+			out := g.inline(span[1 : len(span)-1])
+			t.Body = replace(t.Body, out, f.i+offset, f.w)
+			offset += utf8.RuneCountInString(out) - f.w
+		case lineBreak:
+			t.Body = replace(t.Body, fstr[f.kind], f.i+offset, f.w)
+			offset += utf8.RuneCountInString(fstr[f.kind]) - f.w
+		case imageClose, footnoteClose, mathClose, inlineClose, lineBreakClose:
 		case anchorClose:
 			if t.Body[f.w+offset] == ')' {
 				t.Body = replace(t.Body, fstr[f.kind], f.extra+offset, f.w-f.extra+1)
@@ -457,31 +901,120 @@ func (g *Generator) text(t *ast.Text, w io.Writer) (n int, err error) {
 }
 
 func (g *Generator) list(l *ast.List, w io.Writer) error {
-	currTab := 0
-	w.Write([]byte("<ul>"))
+	if g.DefinitionLists && definitions(l) {
+		w.Write([]byte("<dl>"))
+		for _, li := range l.Items {
+			w.Write([]byte("<dt>"))
+			g.text(&li.Label, w)
+			w.Write([]byte("</dt><dd>"))
+			g.text(&li.Text, w)
+			w.Write([]byte("</dd>"))
+		}
+		w.Write([]byte("</dl>"))
+		return nil
+	}
+	var open []string // tags of the open lists, one per level of indentation
 	for _, li := range l.Items {
-		diffTab := li.NTab - currTab
-		currTab = li.NTab
-		for diffTab > 0 {
-			w.Write([]byte("<ul>"))
-			diffTab--
+		tag := "ul"
+		if li.Ordered {
+			tag = "ol"
 		}
-		for diffTab < 0 {
-			w.Write([]byte("</ul>"))
-			diffTab++
+		for len(open) > li.NTab+1 {
+			fmt.Fprintf(w, "</%s>", open[len(open)-1])
+			open = open[:len(open)-1]
+		}
+		// An item of a different kind, or with a start number, begins a new list.
+		if len(open) == li.NTab+1 && (open[li.NTab] != tag || li.HasStart) {
+			fmt.Fprintf(w, "</%s>", open[li.NTab])
+			open = open[:li.NTab]
+		}
+		for len(open) < li.NTab+1 {
+			if len(open) == li.NTab && li.HasStart {
+				fmt.Fprintf(w, "<%s start=\"%d\">", tag, li.Start)
+			} else {
+				fmt.Fprintf(w, "<%s>", tag)
+			}
+			open = append(open, tag)
 		}
-		if len(li.Label) != 0 {
+		switch {
+		case li.Check != ast.CheckNone:
+			w.Write([]byte("<li class=\"task\">"))
+			w.Write([]byte(checkboxes[li.Check]))
+		case len(li.Label.Body) != 0, li.Ordered:
 			w.Write([]byte("<li>"))
-			fmt.Fprintf(w, "<span>%s</span>", li.Label)
-		} else {
+		default:
 			w.Write([]byte("<li class=\"bullet\">"))
 		}
+		if len(li.Label.Body) != 0 {
+			w.Write([]byte("<span>"))
+			g.text(&li.Label, w)
+			w.Write([]byte("</span>"))
+		}
 		g.text(&li.Text, w)
 		w.Write([]byte("</li>"))
 	}
-	for currTab >= 0 {
-		w.Write([]byte("</ul>"))
-		currTab--
+	for len(open) > 0 {
+		fmt.Fprintf(w, "</%s>", open[len(open)-1])
+		open = open[:len(open)-1]
+	}
+	return nil
+}
+
+// checkboxes holds the disabled checkbox of a task in each state.
+var checkboxes = map[ast.Check]string{
+	ast.CheckOpen: `<input type="checkbox" disabled>`,
+	ast.CheckDone: `<input type="checkbox" checked disabled>`,
+}
+
+// definitions reports whether l can be written as a definition list, which is
+// when its items are all labeled, and none are numbered, indented, or tasks.
+func definitions(l *ast.List) bool {
+	for _, li := range l.Items {
+		if len(li.Label.Body) == 0 || li.Ordered || li.NTab > 0 || li.Check != ast.CheckNone {
+			return false
+		}
+	}
+	return true
+}
+
+// aligns maps the alignment of a column to the style of its cells.
+var aligns = [...]string{
+	ast.AlignLeft:   ` style="text-align:left"`,
+	ast.AlignCenter: ` style="text-align:center"`,
+	ast.AlignRight:  ` style="text-align:right"`,
+}
+
+func (g *Generator) table(t *ast.Table, w io.Writer) error {
+	w.Write([]byte("<table>"))
+	for i, row := range t.Rows {
+		tag := "td"
+		switch {
+		case i < t.NHeader:
+			tag = "th"
+			if i == 0 {
+				w.Write([]byte("<thead>"))
+			}
+		case i == t.NHeader:
+			w.Write([]byte("<tbody>"))
+		}
+		w.Write([]byte("<tr>"))
+		for j, c := range row.Cells {
+			var style string
+			if j < len(t.Align) {
+				style = aligns[t.Align[j]]
+			}
+			fmt.Fprintf(w, "<%s%s>", tag, style)
+			g.text(&c.Text, w)
+			fmt.Fprintf(w, "</%s>", tag)
+		}
+		w.Write([]byte("</tr>"))
+		if i == t.NHeader-1 {
+			w.Write([]byte("</thead>"))
+		}
+	}
+	if len(t.Rows) > t.NHeader {
+		w.Write([]byte("</tbody>"))
 	}
+	w.Write([]byte("</table>"))
 	return nil
 }
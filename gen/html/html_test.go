@@ -25,8 +25,15 @@ package html_test
 
 import (
 	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"akhil.cc/mexdown/gen/html"
 	"akhil.cc/mexdown/parser"
@@ -59,3 +66,846 @@ func TestEscape(t *testing.T) {
 		}
 	}
 }
+
+func TestEnv(t *testing.T) {
+	src := "```true\n```\n" +
+		"```sh -c 'echo $MEXDOWN_BACKEND $MEXDOWN_DIRECTIVE_INDEX $MEXDOWN_OUTDIR $GOPHER'\n```\n" +
+		"```sh -c 'basename $MEXDOWN_SOURCE; basename $(pwd)'\n```\n" +
+		"```MEXDOWN_RETRIES=1 X=x sh -c 'echo ${MEXDOWN_RETRIES-unset} $X'\n```"
+	dir, err := ioutil.TempDir("", "mexdown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := parser.MustParse(strings.NewReader(src))
+	g := html.Gen(file)
+	g.Source = filepath.Join(dir, "env.xd")
+	g.OutDir = "/out"
+	g.Env = []string{"GOPHER=gopher", "MEXDOWN_OUTDIR=/override"}
+	got, err := g.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "html 1 /override gopher\nenv.xd\n" + filepath.Base(dir) + "\nunset x\n"
+	if string(got) != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	// A directive from an included file runs beside that file.
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(sub, "inc.xd"), []byte(src), 0666); err != nil {
+		t.Fatal(err)
+	}
+	main := filepath.Join(dir, "main.xd")
+	file, err = parser.ParseFile(main, strings.NewReader("```{include=sub/inc.xd}\n```\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g = html.Gen(file)
+	g.Source = main
+	if got, err = g.Output(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(got), "\ninc.xd\nsub\n") {
+		t.Errorf("want source and directory of included file, got %q", got)
+	}
+}
+
+func TestDirectiveError(t *testing.T) {
+	src := "# Errors\n" +
+		"```sh -c 'echo partial; echo oops 1>&2; exit 3'\n```\n" +
+		"```sh -c 'echo unreachable'\n```"
+	file := parser.MustParse(strings.NewReader(src))
+	g := html.Gen(file)
+	g.Source = "errors.xd"
+	got, err := g.Output()
+	derr, ok := err.(*html.DirectiveError)
+	if !ok {
+		t.Fatalf("want *html.DirectiveError, got %T (%v)", err, err)
+	}
+	if derr.Line != 2 || derr.Index != 0 || derr.ExitCode != 3 || string(derr.Stderr) != "oops\n" {
+		t.Errorf("unexpected error fields: %+v", derr)
+	}
+	want := "errors.xd:2: directive 0 \"sh -c 'echo partial; echo oops 1>&2; exit 3'\": exit status 3\n\toops"
+	if derr.Error() != want {
+		t.Errorf("want error %q, got %q", want, derr.Error())
+	}
+	if wantOut := "<h1> Errors</h1>partial\n"; string(got) != wantOut {
+		t.Errorf("want %q, got %q", wantOut, got)
+	}
+}
+
+func TestContinueOnError(t *testing.T) {
+	src := "```false\n```\n" +
+		"```echo ok\n```\n" +
+		"```sh -c 'exit 2'\n```"
+	file := parser.MustParse(strings.NewReader(src))
+	g := html.Gen(file)
+	g.ContinueOnError = true
+	got, err := g.Output()
+	errs, ok := err.(html.DirectiveErrors)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("want 2 html.DirectiveErrors, got %T (%v)", err, err)
+	}
+	if errs[0].Index != 0 || errs[1].Index != 2 || errs[1].ExitCode != 2 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+	want := `<pre class="directive-error">line 1: directive 0 &#34;false&#34;: exit status 1</pre>` +
+		"ok\n" +
+		`<pre class="directive-error">line 5: directive 2 &#34;sh -c &#39;exit 2&#39;&#34;: exit status 2</pre>`
+	if string(got) != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	src := "```MEXDOWN_TIMEOUT=50ms sleep 5\n```"
+	file := parser.MustParse(strings.NewReader(src))
+	g := html.Gen(file)
+	g.Timeout = time.Minute
+	_, err := g.Output()
+	derr, ok := err.(*html.DirectiveError)
+	if !ok {
+		t.Fatalf("want *html.DirectiveError, got %T (%v)", err, err)
+	}
+	if !derr.TimedOut || derr.Error() != `line 1: directive 0 "MEXDOWN_TIMEOUT=50ms sleep 5": timed out after 50ms` {
+		t.Errorf("unexpected error: %v", derr)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	// The command fails on its first two attempts.
+	src := "```sh -c 'echo >> attempts; [ $(wc -l < attempts) -gt 2 ] && echo ok'\n```"
+	dir, err := ioutil.TempDir("", "mexdown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := parser.MustParse(strings.NewReader(src))
+	g := html.Gen(file)
+	g.Source = filepath.Join(dir, "retries.xd")
+	g.Retries = 2
+	g.RetryDelay = time.Millisecond
+	got, err := g.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "ok\n" {
+		t.Errorf("want %q, got %q", "ok\n", got)
+	}
+
+	os.Remove(filepath.Join(dir, "attempts"))
+	g = html.Gen(parser.MustParse(strings.NewReader("```MEXDOWN_RETRIES=1 " + src[3:])))
+	if g.RetryDelay != time.Second {
+		t.Errorf("want default retry delay of 1s, got %v", g.RetryDelay)
+	}
+	g.Source = filepath.Join(dir, "retries.xd")
+	g.RetryDelay = time.Millisecond
+	if _, err := g.Output(); err == nil || err.(*html.DirectiveError).Attempts != 2 {
+		t.Errorf("want failure after 2 attempts, got %v", err)
+	}
+	// Only the files of the successful attempt are collected as artifacts.
+	os.Remove(filepath.Join(dir, "attempts"))
+	src = "```sh -c 'echo >> attempts; touch $MEXDOWN_ARTIFACTS/$(wc -l < attempts); [ $(wc -l < attempts) -gt 1 ]'\n```"
+	g = html.Gen(parser.MustParse(strings.NewReader(src)))
+	g.Source = filepath.Join(dir, "retries.xd")
+	g.OutDir = dir
+	g.Retries = 1
+	g.RetryDelay = time.Millisecond
+	if _, err := g.Output(); err != nil {
+		t.Fatal(err)
+	}
+	if arts := g.Artifacts(); len(arts) != 1 || arts[0].Name != "2" {
+		t.Errorf("want only the artifact of the second attempt, got %+v", arts)
+	}
+}
+
+func TestMediaType(t *testing.T) {
+	const png = `\211PNG\r\n\032\n`
+	src := "```MEXDOWN_TYPE=text/plain echo '<b>'\n```\n" +
+		"```echo '<b>'\n```\n" +
+		"```printf '" + png + "'\n```\n" +
+		"```MEXDOWN_TYPE=application/pdf printf '%%PDF'\n```"
+	dir, err := ioutil.TempDir("", "mexdown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	want := "<pre>&lt;b&gt;\n</pre><b>\n" +
+		`<img src="data:image/png;base64,iVBORw0KGgo=">` +
+		`<a href="data:application/pdf;base64,JVBERg==">directive-3.pdf</a>`
+	file := parser.MustParse(strings.NewReader(src))
+	got, err := html.Gen(file).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	want = "<pre>&lt;b&gt;\n</pre><b>\n" +
+		`<img src="types-2.png"><a href="types-3.pdf">types-3.pdf</a>`
+	file = parser.MustParse(strings.NewReader(src))
+	g := html.Gen(file)
+	g.Source = "types.xd"
+	g.OutDir = dir
+	g.SideFiles = true
+	got, err = g.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "types-3.pdf")); err != nil || string(b) != "%PDF" {
+		t.Errorf("want side file containing %q, got %q (%v)", "%PDF", b, err)
+	}
+
+	file = parser.MustParse(strings.NewReader(src))
+	g = html.Gen(file)
+	g.SideFiles = true
+	if _, err := g.Output(); err == nil || !strings.Contains(err.Error(), "no output directory") {
+		t.Errorf("want missing output directory error, got %v", err)
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	const png = `\211PNG\r\n\032\n`
+	src := "```{id=fig1 class=wide caption=\"Flow & <chart>\"} echo '<b>'\n```\n" +
+		"```{alt=\"A graph\"} printf '" + png + "'\n```\n" +
+		"```{type=text/plain} MEXDOWN_TYPE=text/html echo '<b>'\n```\n" +
+		"```{caption=Raw}\nx < y\n```"
+	want := `<figure id="fig1" class="wide"><b>` + "\n" + `<figcaption>Flow &amp; &lt;chart&gt;</figcaption></figure>` +
+		`<img src="data:image/png;base64,iVBORw0KGgo=" alt="A graph">` +
+		"<pre>&lt;b&gt;\n</pre>" +
+		"<figure><pre>x &lt; y\n</pre><figcaption>Raw</figcaption></figure>"
+	file := parser.MustParse(strings.NewReader(src))
+	got, err := html.Gen(file).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestFrontMatter(t *testing.T) {
+	src := "---\ntitle: Fish & Chips\nrelease-date: 2020\n---\n```{shell=sh} printf %s:%s \"$MEXDOWN_META_TITLE\" \"$MEXDOWN_META_RELEASE_DATE\"\n```"
+	file := parser.MustParse(strings.NewReader(src))
+	g := html.Gen(file)
+	g.Template = template.Must(template.New("page").Parse("<title>{{.Meta.title}}</title>{{.Body}}"))
+	got, err := g.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "<title>Fish &amp; Chips</title>Fish & Chips:2020"; string(got) != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestOrderedList(t *testing.T) {
+	src := "-# one\n\t- a\n\t-#4 b\n\t-# c\n-# two\n- three\n\t\t-# deep"
+	want := "<ol><li> one</li><ul><li class=\"bullet\"> a</li></ul><ol start=\"4\"><li> b</li><li> c</li></ol>" +
+		"<li> two</li></ol><ul><li class=\"bullet\"> three</li><ol><ol><li> deep</li></ol></ol></ul>"
+	file := parser.MustParse(strings.NewReader(src))
+	got, err := html.Gen(file).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	file = parser.MustParse(strings.NewReader("-#0 zero\n-# one"))
+	want = "<ol start=\"0\"><li> zero</li><li> one</li></ol>"
+	if got, err = html.Gen(file).Output(); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestDefinitionList(t *testing.T) {
+	src := "-[*term*] first\n-[other] second\n\n# x\n-[a] b\n- c"
+	file := parser.MustParse(strings.NewReader(src))
+	want := `<ul><li><span><em>term</em></span> first</li><li><span>other</span> second</li></ul>` +
+		`<h1> x</h1><ul><li><span>a</span> b</li><li class="bullet"> c</li></ul>`
+	got, err := html.Gen(file).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	g := html.Gen(file)
+	g.DefinitionLists = true
+	want = `<dl><dt><em>term</em></dt><dd> first</dd><dt>other</dt><dd> second</dd></dl>` +
+		`<h1> x</h1><ul><li><span>a</span> b</li><li class="bullet"> c</li></ul>`
+	if got, err = g.Output(); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestTaskList(t *testing.T) {
+	src := "-[ ] open\n-[x][a] done\n- plain"
+	want := `<ul><li class="task"><input type="checkbox" disabled> open</li>` +
+		`<li class="task"><input type="checkbox" checked disabled><span>a</span> done</li>` +
+		`<li class="bullet"> plain</li></ul>`
+	file := parser.MustParse(strings.NewReader(src))
+	got, err := html.Gen(file).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestTable(t *testing.T) {
+	src := "| A | B |\n|:-|-:|\n| *x* | y |\n| z |\n\n|no|header|"
+	want := `<table><thead><tr><th style="text-align:left">A</th><th style="text-align:right">B</th></tr></thead>` +
+		`<tbody><tr><td style="text-align:left"><em>x</em></td><td style="text-align:right">y</td></tr>` +
+		`<tr><td style="text-align:left">z</td></tr></tbody></table>` +
+		`<table><tbody><tr><td>no</td><td>header</td></tr></tbody></table>`
+	file := parser.MustParse(strings.NewReader(src))
+	got, err := html.Gen(file).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestQuote(t *testing.T) {
+	src := "> quoted\n> ```echo hi\n> ```\n>> nested\n\nafter"
+	want := "<blockquote><p>quoted\n</p>hi\n<blockquote><p>nested\n</p></blockquote></blockquote><p>after</p>"
+	file := parser.MustParse(strings.NewReader(src))
+	got, err := html.Gen(file).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestImage(t *testing.T) {
+	src := "See ![a *\"shot\"*](shot) and ![b.png], **![c](c.png)** ok \\![d]\n[shot]: img/shot.png"
+	want := `<p>See <img src="img/shot.png" alt="a *&#34;shot&#34;*"> and <img src="b.png" alt="">, ` +
+		`<strong><img src="c.png" alt="c"></strong> ok !<a href="d">d</a>` + "\n</p>"
+	file := parser.MustParse(strings.NewReader(src))
+	got, err := html.Gen(file).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	file = parser.MustParse(strings.NewReader("é ![é](x.png) *b* c"))
+	want = `<p>é <img src="x.png" alt="é"> <em>b</em> c</p>`
+	if got, err = html.Gen(file).Output(); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestFootnotes(t *testing.T) {
+	src := "A[^b] b[^a] c[^b] d[^x]\n\n[^a]: *First*.\n[^b]: Second.\n[^b]: Again.\n[^c]: Unused."
+	want := `<p>A<sup class="footnote-ref"><a href="#fn-1" id="fnref-1">1</a></sup> ` +
+		`b<sup class="footnote-ref"><a href="#fn-2" id="fnref-2">2</a></sup> ` +
+		`c<sup class="footnote-ref"><a href="#fn-1" id="fnref-1-2">1</a></sup> d[^x]` + "\n\n</p>" +
+		`<section class="footnotes"><ol>` +
+		`<li id="fn-1">Second. <a href="#fnref-1" class="footnote-backref">&#8617;</a> <a href="#fnref-1-2" class="footnote-backref">&#8617;</a></li>` +
+		`<li id="fn-2"><em>First</em>. <a href="#fnref-2" class="footnote-backref">&#8617;</a></li>` +
+		`</ol></section>`
+	wantErr := "doc.xd: warning: footnote [^b] is defined more than once\n" +
+		"doc.xd: warning: footnote [^x] is not defined\n" +
+		"doc.xd: warning: footnote [^c] is defined but not referenced\n"
+	file := parser.MustParse(strings.NewReader(src))
+	var stdout, stderr bytes.Buffer
+	g := html.Gen(file)
+	g.Source = "doc.xd"
+	g.Stdout, g.Stderr = &stdout, &stderr
+	if err := g.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if got := stdout.String(); got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if got := stderr.String(); got != wantErr {
+		t.Errorf("want warnings %q, got %q", wantErr, got)
+	}
+
+	file = parser.MustParse(strings.NewReader("é a[^é] *b* c\n\n[^é]: Note."))
+	want = `<p>é a<sup class="footnote-ref"><a href="#fn-1" id="fnref-1">1</a></sup> <em>b</em> c` + "\n\n</p>" +
+		`<section class="footnotes"><ol>` +
+		`<li id="fn-1">Note. <a href="#fnref-1" class="footnote-backref">&#8617;</a></li>` +
+		`</ol></section>`
+	stdout.Reset()
+	stderr.Reset()
+	g = html.Gen(file)
+	g.Stdout, g.Stderr = &stdout, &stderr
+	if err := g.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if got := stdout.String(); got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if got := stderr.String(); got != "" {
+		t.Errorf("want no warnings, got %q", got)
+	}
+}
+
+func TestMath(t *testing.T) {
+	src := "$a<b$ and $$\\sum x$$, $a<b$ again"
+	file := parser.MustParse(strings.NewReader(src))
+	want := `<p><span class="math inline">\(a&lt;b\)</span> and <span class="math display">\[\sum x\]</span>, ` +
+		`<span class="math inline">\(a&lt;b\)</span> again</p>`
+	got, err := html.Gen(file).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	file = parser.MustParse(strings.NewReader(src))
+	g := html.Gen(file)
+	g.Math = func(tex string, display bool) (string, error) {
+		if display {
+			return "<math display=\"block\">" + tex + "</math>", nil
+		}
+		return "<math>" + tex + "</math>", nil
+	}
+	want = `<p><math>a<b</math> and <math display="block">\sum x</math>, <math>a<b</math> again</p>`
+	if got, err = g.Output(); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	file = parser.MustParse(strings.NewReader("$α$ *b* c"))
+	g = html.Gen(file)
+	g.Math = func(tex string, display bool) (string, error) {
+		return "<math><mi>" + tex + "</mi><mi>β</mi></math>", nil
+	}
+	want = `<p><math><mi>α</mi><mi>β</mi></math> <em>b</em> c</p>`
+	if got, err = g.Output(); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	dir, err := ioutil.TempDir("", "mexdown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file = parser.MustParse(strings.NewReader(src))
+	g = html.Gen(file)
+	g.Source = filepath.Join(dir, "doc.xd")
+	g.Shell = "sh"
+	g.MathCommand = `echo >> runs; printf '<m d="%s">%s</m>' "$MEXDOWN_MATH_DISPLAY" "$(cat)"`
+	want = `<p><m d="0">a<b</m> and <m d="1">\sum x</m>, <m d="0">a<b</m> again</p>`
+	if got, err = g.Output(); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if runs, err := ioutil.ReadFile(filepath.Join(dir, "runs")); err != nil || len(runs) != 2 {
+		t.Errorf("want command run twice, got %d runs (%v)", len(runs), err)
+	}
+
+	file = parser.MustParse(strings.NewReader(src))
+	g = html.Gen(file)
+	g.MathCommand = "false"
+	if _, err := g.Output(); err == nil || !strings.Contains(err.Error(), `math "a<b"`) {
+		t.Errorf("want math error, got %v", err)
+	}
+
+	file = parser.MustParse(strings.NewReader("$x$\n\n```sh -c 'exit 3'\n```"))
+	g = html.Gen(file)
+	g.MathCommand = "false"
+	g.ContinueOnError = true
+	var stderr bytes.Buffer
+	g.Stderr = &stderr
+	_, err = g.Output()
+	if errs, ok := err.(html.DirectiveErrors); !ok || len(errs) != 1 || errs[0].ExitCode != 3 {
+		t.Errorf("want directive errors, got %v", err)
+	}
+	if !strings.Contains(stderr.String(), `warning: math "x"`) {
+		t.Errorf("want math warning, got %q", stderr.String())
+	}
+
+	file = parser.MustParse(strings.NewReader(src))
+	g = html.Gen(file)
+	g.Source = filepath.Join(dir, "doc.xd")
+	g.MathCommand = "touch dry-run"
+	g.DryRun = true
+	want = `<p><span class="math inline">\(a&lt;b\)</span> and <span class="math display">\[\sum x\]</span>, <span class="math inline">\(a&lt;b\)</span> again</p>`
+	if got, err = g.Output(); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dry-run")); err == nil {
+		t.Error("math command was run with DryRun set")
+	}
+
+	rec := new(html.Recording)
+	g = html.Gen(parser.MustParse(strings.NewReader(src)))
+	g.Shell = "sh"
+	g.MathCommand = `printf '<m d="%s">%s</m>' "$MEXDOWN_MATH_DISPLAY" "$(cat)"`
+	g.Record = rec
+	recorded, err := g.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Entries) != 2 || rec.Entries[1].Command != "MEXDOWN_MATH_DISPLAY=1 "+g.MathCommand {
+		t.Errorf("unexpected recording: %+v", rec)
+	}
+	g = html.Gen(parser.MustParse(strings.NewReader(src)))
+	g.MathCommand = `printf '<m d="%s">%s</m>' "$MEXDOWN_MATH_DISPLAY" "$(cat)"`
+	g.Replay = rec
+	if got, err = g.Output(); err != nil || !bytes.Equal(got, recorded) {
+		t.Errorf("want replayed %q, got %q (%v)", recorded, got, err)
+	}
+
+	file = parser.MustParse(strings.NewReader("---\ntitle: T\n---\n$x$"))
+	g = html.Gen(file)
+	g.Shell = "sh"
+	g.MathCommand = `printf '%s %s' "$MEXDOWN_BACKEND" "$MEXDOWN_META_TITLE"`
+	want = "<p>html T</p>"
+	if got, err = g.Output(); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestInlineDirective(t *testing.T) {
+	src := "Version `!{echo 1.2}x`, `!{tr a-z A-Z}<b>` and `!{MEXDOWN_TYPE=text/plain cat}a<b`.\n\n```sh\necho block\n```"
+	file := parser.MustParse(strings.NewReader(src))
+	want := "<p>Version 1.2, <B> and a&lt;b.\n\n</p>block\n"
+	got, err := html.Gen(file).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	file = parser.MustParse(strings.NewReader("Use `{\"a\": 1}` as config"))
+	want = "<p>Use <code>{&#34;a&#34;: 1}</code> as config</p>"
+	if got, err = html.Gen(file).Output(); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	file = parser.MustParse(strings.NewReader("é `!{echo é}x` *b* `!{echo hi}` z"))
+	want = "<p>é é <em>b</em> hi z</p>"
+	if got, err = html.Gen(file).Output(); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	file = parser.MustParse(strings.NewReader(src))
+	g := html.Gen(file)
+	var cmds []string
+	for _, info := range g.Directives() {
+		cmds = append(cmds, fmt.Sprintf("%d %s", info.Index, info.Command))
+	}
+	wantCmds := []string{"0 echo 1.2", "1 tr a-z A-Z", "2 MEXDOWN_TYPE=text/plain cat", "3 sh"}
+	if !reflect.DeepEqual(cmds, wantCmds) {
+		t.Errorf("want directives %q, got %q", wantCmds, cmds)
+	}
+
+	// Directives in footnotes run after the file's statements,
+	// in the order that the footnotes are numbered.
+	src2 := "[^n]: n `!{echo n}`\n[^m]: m `!{echo m}` [^n]\n[^u]: `!{echo u}`\n\na[^m] `!{echo a}`"
+	g = html.Gen(parser.MustParse(strings.NewReader(src2)))
+	cmds = nil
+	for _, info := range g.Directives() {
+		cmds = append(cmds, fmt.Sprintf("%d %s", info.Index, info.Command))
+	}
+	wantCmds = []string{"0 echo a", "1 echo m", "2 echo n"}
+	if !reflect.DeepEqual(cmds, wantCmds) {
+		t.Errorf("want directives %q, got %q", wantCmds, cmds)
+	}
+	g = html.Gen(parser.MustParse(strings.NewReader(strings.Replace(src2, "{echo ", "{sh -c 'echo $MEXDOWN_DIRECTIVE_INDEX' ", -1))))
+	if got, err = g.Output(); err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range []string{"</sup> 0</p>", ">m 1 <sup", ">n 2 <a"} {
+		if !strings.Contains(string(got), w) {
+			t.Errorf("want output containing %q, got %q", w, got)
+		}
+	}
+
+	g = html.Gen(file)
+	g.DryRun = true
+	want = "<p>Version <code>x</code>, <code>&lt;b&gt;</code> and <code>a&lt;b</code>.\n\n</p><pre>echo block\n</pre>"
+	if got, err = g.Output(); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	file = parser.MustParse(strings.NewReader("a `!{false}b` c\n# d"))
+	if got, err = html.Gen(file).Output(); err == nil {
+		t.Errorf("want error, got nil")
+	} else if want := "<p>a <code>b</code> c\n</p>"; string(got) != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	g = html.Gen(file)
+	g.ContinueOnError = true
+	got, err = g.Output()
+	if errs, ok := err.(html.DirectiveErrors); !ok || len(errs) != 1 {
+		t.Fatalf("want 1 directive error, got %v", err)
+	}
+	if !strings.Contains(string(got), `<code class="directive-error">`) || !strings.HasSuffix(string(got), "<h1> d</h1>") {
+		t.Errorf("want inline error and remaining output, got %q", got)
+	}
+}
+
+func TestRule(t *testing.T) {
+	file := parser.MustParse(strings.NewReader("# a\n---\n# b\n===\n# c"))
+	want := `<h1> a</h1><hr><h1> b</h1><hr class="page-break" style="break-after: page"><h1> c</h1>`
+	got, err := html.Gen(file).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestComment(t *testing.T) {
+	file := parser.MustParse(strings.NewReader("# a\n// TODO: remove\n/* draft\n*/\n# b"))
+	want := "<h1> a</h1><h1> b</h1>"
+	got, err := html.Gen(file).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestCommentInParagraph(t *testing.T) {
+	file := parser.MustParse(strings.NewReader("a\n// note\nb"))
+	want := "<p>a\nb</p>"
+	got, err := html.Gen(file).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestLineBreak(t *testing.T) {
+	src := "roses\\\nviolets  \n*blue*  \n`c  \nd` e  \n\n"
+	want := "<p>roses<br>\nviolets<br>\n<em>blue</em><br>\n<code>c  \nd</code> e  \n\n</p>"
+	file := parser.MustParse(strings.NewReader(src))
+	got, err := html.Gen(file).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestArtifacts(t *testing.T) {
+	src := "```sh -c 'cd $MEXDOWN_ARTIFACTS; echo a > a.txt; mkdir sub; echo b > sub/b.txt; echo $MEXDOWN_ARTIFACTS_URL'\n```"
+	dir, err := ioutil.TempDir("", "mexdown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := parser.MustParse(strings.NewReader(src))
+	g := html.Gen(file)
+	g.Source = "artifacts.xd"
+	g.OutDir = dir
+	got, err := g.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "artifacts-0/\n" {
+		t.Errorf("want %q, got %q", "artifacts-0/\n", got)
+	}
+	want := []html.Artifact{
+		{Index: 0, Name: "a.txt", Path: filepath.Join(dir, "artifacts-0", "a.txt")},
+		{Index: 0, Name: "sub/b.txt", Path: filepath.Join(dir, "artifacts-0", "sub", "b.txt")},
+	}
+	if !reflect.DeepEqual(g.Artifacts(), want) {
+		t.Errorf("want artifacts %v, got %v", want, g.Artifacts())
+	}
+	for _, a := range want {
+		if b, err := ioutil.ReadFile(a.Path); err != nil || len(b) != 2 {
+			t.Errorf("artifact %s: got %q (%v)", a.Name, b, err)
+		}
+	}
+
+	g = html.Gen(parser.MustParse(strings.NewReader(src)))
+	g.Source = filepath.Join(dir, "artifacts.xd")
+	if _, err := g.Output(); err == nil || !strings.Contains(err.Error(), "no output directory") {
+		t.Errorf("want missing output directory error, got %v", err)
+	}
+}
+
+func TestDirectives(t *testing.T) {
+	src := "```\nraw\n```\n" +
+		"```X=1 MEXDOWN_RETRIES=2 sh -c 'exit 1'\n```\n" +
+		"```mexdown-no-such-command\n```"
+	file := parser.MustParse(strings.NewReader(src))
+	g := html.Gen(file)
+	g.DryRun = true
+	infos := g.Directives()
+	if len(infos) != 3 {
+		t.Fatalf("want 3 directives, got %d", len(infos))
+	}
+	if infos[0].Run || infos[0].Err != nil || infos[0].Line != 1 {
+		t.Errorf("raw directive: got %+v", infos[0])
+	}
+	if !infos[1].Run || infos[1].Index != 1 || len(infos[1].Stages) != 1 || infos[1].Stages[0].Path == "" ||
+		!reflect.DeepEqual(infos[1].Stages[0].Env, []string{"X=1"}) ||
+		!reflect.DeepEqual(infos[1].Stages[0].Args, []string{"sh", "-c", "exit 1"}) {
+		t.Errorf("sh directive: got %+v", infos[1])
+	}
+	if infos[2].Run || infos[2].Err == nil {
+		t.Errorf("missing command: got %+v", infos[2])
+	}
+	got, err := g.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "<pre>raw\n</pre><pre></pre><pre></pre>"
+	if string(got) != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	src := "```sh -c 'cat; echo warning 1>&2; echo a > $MEXDOWN_ARTIFACTS/a.txt'\n<b>input</b>\n```\n" +
+		"```sh -c 'exit 4'\n```"
+	dir, err := ioutil.TempDir("", "mexdown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rec := new(html.Recording)
+	file := parser.MustParse(strings.NewReader(src))
+	g := html.Gen(file)
+	g.Record = rec
+	g.ContinueOnError = true
+	g.OutDir = dir
+	want, err := g.CombinedOutput()
+	if err == nil {
+		t.Fatal("want error from second directive")
+	}
+	var b bytes.Buffer
+	if _, err := rec.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	if rec, err = html.ReadRecording(&b); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Entries) != 2 || rec.Entries[1].ExitCode != 4 || rec.Entries[0].Artifacts["a.txt"] == nil {
+		t.Fatalf("unexpected recording: %+v", rec)
+	}
+
+	os.RemoveAll(filepath.Join(dir, "directive-0"))
+	file = parser.MustParse(strings.NewReader(src))
+	g = html.Gen(file)
+	g.Replay = rec
+	g.ContinueOnError = true
+	g.OutDir = dir
+	got, err := g.CombinedOutput()
+	if errs, ok := err.(html.DirectiveErrors); !ok || len(errs) != 1 || errs[0].ExitCode != 4 {
+		t.Errorf("want replayed exit code 4, got %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "directive-0", "a.txt")); err != nil {
+		t.Errorf("artifact was not replayed: %v", err)
+	}
+
+	file = parser.MustParse(strings.NewReader(strings.Replace(src, "input", "changed", 1)))
+	g = html.Gen(file)
+	g.Replay = rec
+	if _, err := g.Output(); err == nil || !strings.Contains(err.Error(), "input changed") {
+		t.Errorf("want changed input to be reported, got %v", err)
+	}
+
+	src = "```MEXDOWN_TIMEOUT=50ms sleep 5\n```"
+	rec = new(html.Recording)
+	g = html.Gen(parser.MustParse(strings.NewReader(src)))
+	g.Record = rec
+	if _, err := g.Output(); err == nil {
+		t.Fatal("want timeout error")
+	}
+	g = html.Gen(parser.MustParse(strings.NewReader(src)))
+	g.Replay = rec
+	_, err = g.Output()
+	if derr, ok := err.(*html.DirectiveError); !ok || !derr.TimedOut {
+		t.Errorf("want replayed timeout, got %v", err)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	tests := []struct {
+		in, want string
+		err      bool
+	}{
+		{"```printf 'b\\na\\n' | sort | tr a-z A-Z\n```", "A\nB\n", false},
+		{"```echo '|' \\| \"|\"\n```", "| | |\n", false},
+		{"```X=1 sh -c 'echo $X' | Y=2 sh -c 'cat; echo $X$Y'\n```", "1\n2\n", false},
+		{"```false | cat\n```", "", true},
+		{"```echo | false\n```", "", true},
+		{"```yes | head -1\n```", "y\n", false},
+		{"```sh -c 'kill -PIPE $$'\n```", "", true},
+		{"```echo ||\n```", "", true},
+		{"```MEXDOWN_TIMEOUT=50ms sleep 5 | sleep 5\n```", "", true},
+		{"```MEXDOWN_SHELL=sh echo a && echo b\n```", "a\nb\n", false},
+	}
+	for i, test := range tests {
+		file := parser.MustParse(strings.NewReader(test.in))
+		start := time.Now()
+		got, err := html.Gen(file).Output()
+		if (err != nil) != test.err {
+			t.Errorf("case %d, in %q: unexpected error %v", i, test.in, err)
+		}
+		if string(got) != test.want {
+			t.Errorf("case %d, in %q,\nwant %q,\ngot %q", i, test.in, test.want, got)
+		}
+		if time.Since(start) > 3*time.Second {
+			t.Errorf("case %d, in %q: pipeline was not cancelled", i, test.in)
+		}
+	}
+}
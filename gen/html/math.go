@@ -0,0 +1,166 @@
+// MIT License
+
+// Copyright (c) 2018 Akhil Indurti
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package html
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"akhil.cc/mexdown/ast"
+	sq "github.com/kballard/go-shellquote"
+)
+
+// mathMarkup holds the markup for inline and display math
+// that is recognized by KaTeX's auto-render extension.
+var mathMarkup = map[bool]string{
+	false: `<span class="math inline">\(%s\)</span>`,
+	true:  `<span class="math display">\[%s\]</span>`,
+}
+
+type mathKey struct {
+	tex     string
+	display bool
+}
+
+// math returns the HTML for the TeX source of math. If the math cannot be
+// converted, it is written as markup instead, and the error is recorded, or
+// reported as a warning if the generator continues on error.
+func (g *Generator) math(tex string, display bool) string {
+	key := mathKey{tex, display}
+	if out, ok := g.mathCache[key]; ok {
+		return out
+	}
+	var out string
+	var err error
+	switch {
+	case g.Math != nil:
+		out, err = g.Math(tex, display)
+	case g.MathCommand != "" && !g.DryRun:
+		out, err = g.mathCommand(tex, display)
+	default:
+		return fmt.Sprintf(mathMarkup[display], html.EscapeString(tex))
+	}
+	if err != nil {
+		switch {
+		case g.ContinueOnError:
+			g.warnf("math %q: %v", tex, err)
+		case g.mathErr == nil:
+			g.mathErr = fmt.Errorf("math %q: %v", tex, err)
+		}
+		return fmt.Sprintf(mathMarkup[display], html.EscapeString(tex))
+	}
+	if g.mathCache == nil {
+		g.mathCache = make(map[mathKey]string)
+	}
+	g.mathCache[key] = out
+	return out
+}
+
+// mathCommand runs the generator's MathCommand on tex, and returns its
+// standard output. Its results are recorded and replayed like those of
+// a directive, whose command line assigns MEXDOWN_MATH_DISPLAY before the
+// math command and whose raw string is tex.
+func (g *Generator) mathCommand(tex string, display bool) (string, error) {
+	disp := "0"
+	if display {
+		disp = "1"
+	}
+	d := &ast.Directive{Command: "MEXDOWN_MATH_DISPLAY=" + disp + " " + g.MathCommand, Raw: tex}
+	if g.Replay != nil {
+		e, err := g.Replay.lookup(d)
+		switch {
+		case err != nil:
+			return "", err
+		case e.Error != "":
+			return "", errors.New(e.Error)
+		}
+		return string(e.Stdout), nil
+	}
+	out, stderr, err := g.runMath(tex, disp)
+	if g.Record != nil {
+		e := Entry{Command: d.Command, Input: inputHash(d.Raw), Stdout: out, Stderr: stderr}
+		if err != nil {
+			e.ExitCode = -1
+			if ee, ok := err.(*exec.ExitError); ok {
+				e.ExitCode = ee.ExitCode()
+			}
+			e.Error = err.Error()
+		}
+		g.Record.Entries = append(g.Record.Entries, e)
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(string(stderr)); msg != "" {
+			return "", fmt.Errorf("%v: %s", err, msg)
+		}
+		return "", err
+	}
+	return string(out), nil
+}
+
+// runMath runs the generator's MathCommand with tex on its standard input,
+// and returns its standard output and standard error. Disp is the value of
+// MEXDOWN_MATH_DISPLAY.
+func (g *Generator) runMath(tex, disp string) (stdout, stderr []byte, err error) {
+	var args []string
+	if g.Shell != "" {
+		args = []string{g.Shell, "-c", g.MathCommand}
+	} else {
+		words, err := sq.Split(g.MathCommand)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(words) == 0 {
+			return nil, nil, fmt.Errorf("no valid commands")
+		}
+		args = words
+	}
+	ctx, cancel := context.WithCancel(g.ctx)
+	if g.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(g.ctx, g.Timeout)
+	}
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	if g.Source != "" {
+		cmd.Dir = filepath.Dir(g.Source)
+	}
+	env := append(os.Environ(),
+		"MEXDOWN_BACKEND=html",
+		"MEXDOWN_SOURCE="+abs(g.Source),
+		"MEXDOWN_OUTDIR="+abs(g.OutDir),
+		"MEXDOWN_MATH_DISPLAY="+disp,
+	)
+	cmd.Env = append(g.metaEnviron(env), g.Env...)
+	cmd.Stdin = strings.NewReader(tex)
+	var out, errb bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &errb
+	err = cmd.Run()
+	return out.Bytes(), errb.Bytes(), err
+}
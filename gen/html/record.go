@@ -0,0 +1,177 @@
+// MIT License
+
+// Copyright (c) 2018 Akhil Indurti
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package html
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"akhil.cc/mexdown/ast"
+)
+
+// A Recording holds the results of directive commands, so that a document
+// can be generated again without the commands being available.
+//
+// Results are keyed by a directive's command line and a hash of its raw
+// string. The environment and working directory of a command are not
+// part of the key.
+type Recording struct {
+	Entries []Entry `json:"entries"`
+}
+
+// An Entry is the recorded result of a directive's command.
+type Entry struct {
+	Command   string            `json:"command"`
+	Input     string            `json:"input"` // SHA-256 hash of the raw string, in hexadecimal
+	Stdout    []byte            `json:"stdout"`
+	Stderr    []byte            `json:"stderr,omitempty"`
+	ExitCode  int               `json:"exit_code"`
+	TimedOut  bool              `json:"timed_out,omitempty"`
+	Error     string            `json:"error,omitempty"`
+	Artifacts map[string][]byte `json:"artifacts,omitempty"` // Keyed by slash-separated path
+}
+
+// ReadRecording reads a recording in JSON format from r.
+func ReadRecording(r io.Reader) (*Recording, error) {
+	var rec Recording
+	if err := json.NewDecoder(r).Decode(&rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// WriteTo writes the recording in JSON format to w.
+func (rec *Recording) WriteTo(w io.Writer) (n int64, err error) {
+	b, err := json.MarshalIndent(rec, "", "\t")
+	if err != nil {
+		return 0, err
+	}
+	m, err := w.Write(append(b, '\n'))
+	return int64(m), err
+}
+
+func inputHash(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// record adds the result of the command of d to the recording, along with
+// any artifacts in its scratch directory.
+func (rec *Recording) record(d *ast.Directive, stdout, stderr []byte, err error, scratch string) error {
+	e := Entry{
+		Command: strings.TrimSuffix(d.Command, "\n"),
+		Input:   inputHash(d.Raw),
+		Stdout:  stdout,
+		Stderr:  stderr,
+	}
+	if err != nil {
+		derr := err.(*DirectiveError)
+		e.ExitCode = derr.ExitCode
+		e.TimedOut = derr.TimedOut
+		e.Error = derr.Err.Error()
+	}
+	walkErr := filepath.Walk(scratch, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(scratch, path)
+		if err != nil {
+			return err
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if e.Artifacts == nil {
+			e.Artifacts = make(map[string][]byte)
+		}
+		e.Artifacts[filepath.ToSlash(rel)] = b
+		return nil
+	})
+	rec.Entries = append(rec.Entries, e)
+	return walkErr
+}
+
+// lookup returns the entry recorded for the command of d.
+func (rec *Recording) lookup(d *ast.Directive) (*Entry, error) {
+	cmd, input := strings.TrimSuffix(d.Command, "\n"), inputHash(d.Raw)
+	changed := false
+	for i := range rec.Entries {
+		e := &rec.Entries[i]
+		if e.Command == cmd {
+			if e.Input == input {
+				return e, nil
+			}
+			changed = true
+		}
+	}
+	if changed {
+		return nil, errors.New("input changed since it was recorded")
+	}
+	return nil, errors.New("command was not recorded")
+}
+
+// replay returns the recorded standard output of the command of d, writes its
+// standard error to stderr, and restores its artifacts into scratch.
+// If the command failed when it was recorded, the details are recorded in derr.
+func (rec *Recording) replay(d *ast.Directive, scratch string, stderr io.Writer, derr *DirectiveError) ([]byte, error) {
+	e, err := rec.lookup(d)
+	if err != nil {
+		derr.Err = err
+		return nil, derr
+	}
+	stderr.Write(e.Stderr)
+	for name, b := range e.Artifacts {
+		rel := filepath.Clean(filepath.FromSlash(name))
+		if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			derr.Err = errors.New("invalid artifact name " + name)
+			return nil, derr
+		}
+		path := filepath.Join(scratch, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			derr.Err = err
+			return nil, derr
+		}
+		if err := ioutil.WriteFile(path, b, 0666); err != nil {
+			derr.Err = err
+			return nil, derr
+		}
+	}
+	if e.Error != "" {
+		derr.Err = errors.New(e.Error)
+		derr.ExitCode = e.ExitCode
+		derr.TimedOut = e.TimedOut
+		tail := &tailWriter{max: stderrTail}
+		tail.Write(e.Stderr)
+		derr.Stderr = tail.b
+		return e.Stdout, derr
+	}
+	return e.Stdout, nil
+}
@@ -0,0 +1,298 @@
+// MIT License
+
+// Copyright (c) 2018 Akhil Indurti
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package literate implements noweb-style literate programming over mexdown
+// syntax trees.
+//
+// A directive is named by its name attribute, and is called a chunk:
+// 	```{name="parse input"}
+// 	buf, err := ioutil.ReadAll(r)
+// 	```
+// Several directives with the same name form a single chunk, whose contents
+// are concatenated in the order that the directives appear in the file.
+//
+// The contents of a chunk are referenced from the body of any directive by a line
+// consisting only of the chunk's name in double angle brackets, such as
+// 	<<parse input>>
+// Expand replaces each such line with the contents of the chunk, indented by
+// the whitespace preceding the reference. References within a chunk are
+// expanded transitively, and a chunk that references itself, directly or
+// indirectly, is an error.
+//
+// A directive with a file attribute names a file that Tangle assembles from
+// the directive's body, such as
+// 	```{file=main.go}
+// 	package main
+//
+// 	<<imports>>
+// 	```
+package literate // import "akhil.cc/mexdown/literate"
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"akhil.cc/mexdown/ast"
+)
+
+// ref matches a line consisting of a chunk reference, capturing the
+// indentation preceding it and the chunk's name.
+var ref = regexp.MustCompile(`^([ \t]*)<<([^<>]+)>>[ \t]*$`)
+
+// expander expands references to the chunks of a file.
+type expander struct {
+	chunks map[string][]*ast.Directive
+	// If non-nil, mark returns a comment that maps the next
+	// line of output to the given line of the file containing d.
+	mark func(d *ast.Directive, line int) string
+	// cache holds the expanded contents of each chunk, by name and indent,
+	// so that a chunk referenced many times is only expanded once.
+	cache map[chunkKey]string
+}
+
+type chunkKey struct {
+	name, indent string
+}
+
+// Chunks returns the directives in f that belong to each named chunk,
+// in the order that they appear.
+func Chunks(f *ast.File) map[string][]*ast.Directive {
+	chunks := make(map[string][]*ast.Directive)
+	ast.Inspect(f, func(n ast.Node) bool {
+		if d, ok := n.(*ast.Directive); ok {
+			if name, ok := d.Attrs["name"]; ok {
+				chunks[name] = append(chunks[name], d)
+			}
+		}
+		return true
+	})
+	return chunks
+}
+
+// Expand replaces the chunk references in the bodies of the directives in f
+// with the contents of the chunks they reference. It returns an error if a
+// reference names an undefined chunk, or if chunks reference each other
+// in a cycle, in which case f is left unmodified.
+func Expand(f *ast.File) error {
+	e := &expander{chunks: Chunks(f)}
+	var dirs []*ast.Directive
+	var raws []string
+	var err error
+	ast.Inspect(f, func(n ast.Node) bool {
+		d, ok := n.(*ast.Directive)
+		if !ok || err != nil {
+			return err == nil
+		}
+		var stack []string
+		if name, ok := d.Attrs["name"]; ok {
+			stack = append(stack, name)
+		}
+		var raw string
+		if raw, err = e.text(d, stack, ""); err == nil {
+			dirs = append(dirs, d)
+			raws = append(raws, raw)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for i, d := range dirs {
+		d.Raw = raws[i]
+	}
+	return nil
+}
+
+// chunk returns the expanded contents of the named chunk, indenting
+// each line by indent. The stack holds the names of the chunks being
+// expanded, outermost first.
+func (e *expander) chunk(name string, stack []string, indent string) (string, error) {
+	key := chunkKey{name, indent}
+	if s, ok := e.cache[key]; ok {
+		return s, nil
+	}
+	var b strings.Builder
+	for _, d := range e.chunks[name] {
+		e.writeMark(&b, d, d.Line+1)
+		s, err := e.text(d, append(stack, name), indent)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(s)
+	}
+	if e.cache == nil {
+		e.cache = make(map[chunkKey]string)
+	}
+	e.cache[key] = b.String()
+	return b.String(), nil
+}
+
+// writeMark writes a comment to b mapping the next line to the given source line.
+func (e *expander) writeMark(b *strings.Builder, d *ast.Directive, line int) {
+	if e.mark == nil {
+		return
+	}
+	if s := b.String(); s != "" && !strings.HasSuffix(s, "\n") {
+		b.WriteString("\n")
+	}
+	b.WriteString(e.mark(d, line) + "\n")
+}
+
+// text returns the body of d with its references expanded, indenting
+// each non-empty line by indent.
+func (e *expander) text(d *ast.Directive, stack []string, indent string) (string, error) {
+	var b strings.Builder
+	lines := strings.SplitAfter(d.Raw, "\n")
+	for i, line := range lines {
+		// The body of a directive starts on the line after its opening backticks.
+		lineno := d.Line + 1 + i
+		m := ref.FindStringSubmatch(strings.TrimSuffix(line, "\n"))
+		if m == nil {
+			if line != "" && line != "\n" {
+				b.WriteString(indent)
+			}
+			b.WriteString(line)
+			continue
+		}
+		name := m[2]
+		if _, ok := e.chunks[name]; !ok {
+			return "", fmt.Errorf("line %d: undefined chunk <<%s>>", lineno, name)
+		}
+		for j, outer := range stack {
+			if outer == name {
+				return "", fmt.Errorf("line %d: chunk <<%s>> references itself: <<%s>>", lineno, name, strings.Join(append(stack[j:], name), ">> -> <<"))
+			}
+		}
+		s, err := e.chunk(name, stack, indent+m[1])
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(s)
+		if s != "" && !strings.HasSuffix(s, "\n") && strings.HasSuffix(line, "\n") {
+			b.WriteString("\n")
+		}
+		if i+1 < len(lines) && lines[i+1] != "" {
+			e.writeMark(&b, d, lineno+1)
+		}
+	}
+	return b.String(), nil
+}
+
+// marks maps file extensions to the format of comments that map lines of
+// a tangled file back to the source, given the source line and file name.
+var marks = map[string]func(line int, file string) string{
+	".c":   cmark,
+	".h":   cmark,
+	".cc":  cmark,
+	".cpp": cmark,
+	".cxx": cmark,
+	".hh":  cmark,
+	".hpp": cmark,
+	".y":   cmark,
+	".l":   cmark,
+	".go": func(line int, file string) string {
+		return fmt.Sprintf("//line %s:%d", file, line)
+	},
+}
+
+func cmark(line int, file string) string {
+	return fmt.Sprintf("#line %d %q", line, file)
+}
+
+// Tangle assembles the files named by the file attributes of the directives in f,
+// and returns their contents keyed by name. The bodies of the directives naming
+// a file are concatenated in the order that they appear, with their references
+// expanded as in Expand. File names must be relative, and may not refer to a
+// parent directory.
+//
+// If source is not empty, it is the name of the file that f was parsed from, and
+// files in languages that support them are given comments mapping their lines
+// back to the source, such as #line directives in C and //line directives in Go.
+// Lines from directives that record their own File are mapped back to that file.
+func Tangle(f *ast.File, source string) (map[string][]byte, error) {
+	chunks := Chunks(f)
+	files := make(map[string]*strings.Builder)
+	var err error
+	ast.Inspect(f, func(n ast.Node) bool {
+		d, ok := n.(*ast.Directive)
+		if !ok || err != nil {
+			return err == nil
+		}
+		name, ok := d.Attrs["file"]
+		if !ok {
+			return true
+		}
+		if err = checkName(name); err != nil {
+			err = fmt.Errorf("line %d: %v", d.Line, err)
+			return false
+		}
+		e := &expander{chunks: chunks}
+		if m, ok := marks[path.Ext(name)]; ok && source != "" {
+			e.mark = func(d *ast.Directive, line int) string {
+				if d.File != "" {
+					return m(line, d.File)
+				}
+				return m(line, source)
+			}
+		}
+		b, ok := files[name]
+		if !ok {
+			b = new(strings.Builder)
+			files[name] = b
+		}
+		var stack []string
+		if name, ok := d.Attrs["name"]; ok {
+			stack = append(stack, name)
+		}
+		e.writeMark(b, d, d.Line+1)
+		var s string
+		if s, err = e.text(d, stack, ""); err == nil {
+			b.WriteString(s)
+		}
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string][]byte, len(files))
+	for name, b := range files {
+		out[name] = []byte(b.String())
+	}
+	return out, nil
+}
+
+// checkName returns an error if name is not a valid name for a tangled file.
+func checkName(name string) error {
+	switch {
+	case name == "":
+		return errors.New("empty file name")
+	case filepath.IsAbs(name) || path.IsAbs(name):
+		return fmt.Errorf("file name %q is absolute", name)
+	case name == ".." || strings.HasPrefix(path.Clean(filepath.ToSlash(name)), "../"):
+		return fmt.Errorf("file name %q refers to a parent directory", name)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+// MIT License
+
+// Copyright (c) 2018 Akhil Indurti
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package literate_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"akhil.cc/mexdown/ast"
+	"akhil.cc/mexdown/literate"
+	"akhil.cc/mexdown/parser"
+)
+
+func directives(f *ast.File) []string {
+	var raws []string
+	ast.Inspect(f, func(n ast.Node) bool {
+		if d, ok := n.(*ast.Directive); ok {
+			raws = append(raws, d.Raw)
+		}
+		return true
+	})
+	return raws
+}
+
+func TestExpand(t *testing.T) {
+	src := "```{name=main}\nfunc main() {\n\t<<body>>\n}\n```\n" +
+		"```{name=body}\nx := 1\n\n<<print>>\n```\n" +
+		"```{name=print}\nfmt.Println(x)\n```\n" +
+		"```{name=body}\nx++\n```\n" +
+		"```cat\n<<main>>\n```"
+	main := "func main() {\n\tx := 1\n\n\tfmt.Println(x)\n\tx++\n}\n"
+	want := []string{main, "x := 1\n\nfmt.Println(x)\n", "fmt.Println(x)\n", "x++\n", main}
+
+	f := parser.MustParse(strings.NewReader(src))
+	if err := literate.Expand(f); err != nil {
+		t.Fatal(err)
+	}
+	got := directives(f)
+	if len(got) != len(want) {
+		t.Fatalf("want %d directives, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("directive %d: want %q, got %q", i, want[i], got[i])
+		}
+	}
+}
+
+func TestExpandDiamond(t *testing.T) {
+	// Each chunk references the next twice, so expanding the first
+	// without reusing the expansions of the others takes 2^n steps.
+	const n = 20
+	var src strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&src, "```{name=c%d}\n<<c%d>>\n\t<<c%d>>\n```\n", i, i+1, i+1)
+	}
+	fmt.Fprintf(&src, "```{name=c%d}\nx\n```\n", n)
+	f := parser.MustParse(strings.NewReader(src.String()))
+	if err := literate.Expand(f); err != nil {
+		t.Fatal(err)
+	}
+	got := directives(f)[0]
+	if lines := strings.Count(got, "\n"); lines != 1<<n {
+		t.Errorf("want %d lines, got %d", 1<<n, lines)
+	}
+	if !strings.HasPrefix(got, "x\n\tx\n") || !strings.HasSuffix(got, "\n"+strings.Repeat("\t", n)+"x\n") {
+		t.Errorf("unexpected expansion: %.20q...", got)
+	}
+}
+
+func TestExpandError(t *testing.T) {
+	for _, tt := range []struct {
+		src, err string
+	}{
+		{"```cat\n<<missing>>\n```", "line 2: undefined chunk <<missing>>"},
+		{"```{name=a}\n<<b>>\n```\n```{name=b}\nx\n<<a>>\n```",
+			"line 6: chunk <<a>> references itself: <<a>> -> <<b>> -> <<a>>"},
+		{"```{name=a}\n<<a>>\n```", "line 2: chunk <<a>> references itself: <<a>> -> <<a>>"},
+	} {
+		f := parser.MustParse(strings.NewReader(tt.src))
+		raws := directives(f)
+		err := literate.Expand(f)
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%q: want error %q, got %v", tt.src, tt.err, err)
+		}
+		for i, raw := range directives(f) {
+			if raw != raws[i] {
+				t.Errorf("%q: directive %d modified after error", tt.src, i)
+			}
+		}
+	}
+}
+
+func TestTangle(t *testing.T) {
+	src := "```{file=main.go}\npackage main\n\nfunc main() {\n\t<<body>>\n}\n```\n" +
+		"```{name=body}\nprintln(1)\n```\n" +
+		"```{file=util.c}\nint x;\n```\n" +
+		"```{file=notes.txt}\nnote\n```\n" +
+		"```{file=util.c}\nint y;\n```"
+	want := map[string]string{
+		"main.go":   "//line doc.xd:2\npackage main\n\nfunc main() {\n//line doc.xd:9\n\tprintln(1)\n//line doc.xd:6\n}\n",
+		"util.c":    "#line 12 \"doc.xd\"\nint x;\n#line 18 \"doc.xd\"\nint y;\n",
+		"notes.txt": "note\n",
+	}
+	f := parser.MustParse(strings.NewReader(src))
+	files, err := literate.Tangle(f, "doc.xd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(want) {
+		t.Errorf("want %d files, got %d", len(want), len(files))
+	}
+	for name, w := range want {
+		if got := string(files[name]); got != w {
+			t.Errorf("%s: want %q, got %q", name, w, got)
+		}
+	}
+
+	files, err = literate.Tangle(f, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, w := string(files["main.go"]), "package main\n\nfunc main() {\n\tprintln(1)\n}\n"; got != w {
+		t.Errorf("main.go: want %q, got %q", w, got)
+	}
+
+	for _, name := range []string{"/etc/passwd", "../x.go", "a/../../x.go"} {
+		f := parser.MustParse(strings.NewReader("```{file=" + name + "}\nx\n```"))
+		if _, err := literate.Tangle(f, ""); err == nil {
+			t.Errorf("%s: want error, got nil", name)
+		}
+	}
+}
@@ -27,8 +27,11 @@
 //   mexdown [command]
 //
 // Available Commands:
+//   directives  List the directives in a mexdown source file without running them
 //   help        Help about any command
 //   html        HTML output generator for mexdown source files
+//   tangle      Extract the files named by directives in a mexdown source file
+//   tasks       Summarize the progress of the tasks in a mexdown source file
 //
 // Flags:
 //   -h, --help   help for mexdown
@@ -39,11 +42,22 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
 	"time"
 
+	"akhil.cc/mexdown/ast"
 	"akhil.cc/mexdown/gen/html"
+	"akhil.cc/mexdown/literate"
 	"akhil.cc/mexdown/parser"
+	sq "github.com/kballard/go-shellquote"
 	"github.com/spf13/cobra"
 )
 
@@ -51,6 +65,37 @@ func prefix(msg string, err error) error {
 	return errors.New(msg + err.Error())
 }
 
+// open opens the input file named by args, if any, and returns it along
+// with its name. Otherwise, it returns standard input and an empty name.
+func open(args []string) (*os.File, string, error) {
+	if len(args) == 0 {
+		return os.Stdin, "", nil
+	}
+	f, err := os.Open(args[0])
+	return f, args[0], err
+}
+
+func readRecording(name string) (*html.Recording, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return html.ReadRecording(f)
+}
+
+func writeRecording(name string, rec *html.Recording) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := rec.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
 func main() {
 	rootCmd := &cobra.Command{
 		Use:   "mexdown generator",
@@ -61,6 +106,14 @@ corresponding output generator on a mexdown source file.`,
 
 	var outputfile string
 	var timeout time.Duration
+	var env []string
+	var keepGoing, sideFiles, expand, definitionLists bool
+	var directiveTimeout, retryDelay time.Duration
+	var retries int
+	var recordfile, replayfile string
+	var shell string
+	var templatefile string
+	var mathCommand string
 	prefixHTML := "(HTML) "
 	htmlCmd := &cobra.Command{
 		Use:   "html [input] [-o output]",
@@ -68,7 +121,8 @@ corresponding output generator on a mexdown source file.`,
 		Long: `This command takes a mexdown syntax tree and converts it to HTML.
 Text inside raw string literals is automatically escaped. Overlapping
 format tags in the source are converted into a tree structure.
-Directives are parsed according to the Bourne shell's word-splitting rules.
+Directives are parsed according to the Bourne shell's word-splitting rules,
+and run in the directory of the input file.
 
 If no input file is specified, input is read from
 standard input. Similarly, if no output argument is
@@ -76,13 +130,9 @@ specified, output is written to standard output.`,
 		Args: cobra.MaximumNArgs(1),
 		DisableFlagsInUseLine: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			src := os.Stdin
-			var err error
-			if len(args) != 0 {
-				src, err = os.Open(args[0])
-				if err != nil {
-					return prefix(prefixHTML, err)
-				}
+			src, name, err := open(args)
+			if err != nil {
+				return prefix(prefixHTML, err)
 			}
 			defer src.Close()
 			out := os.Stdout
@@ -93,10 +143,15 @@ specified, output is written to standard output.`,
 				}
 			}
 			defer out.Close()
-			ast, err := parser.Parse(src)
+			ast, err := parser.ParseFile(name, src)
 			if err != nil {
 				return prefix(prefixHTML, err)
 			}
+			if expand {
+				if err := literate.Expand(ast); err != nil {
+					return prefix(prefixHTML, err)
+				}
+			}
 			ctx := context.Background()
 			if timeout > -1 {
 				var cancel context.CancelFunc
@@ -106,7 +161,44 @@ specified, output is written to standard output.`,
 			g := html.GenContext(ctx, ast)
 			g.Stdout = out
 			g.Stderr = os.Stderr
-			if err := g.Run(); err != nil {
+			if len(args) != 0 {
+				g.Source = args[0]
+			}
+			if len(outputfile) != 0 {
+				g.OutDir = filepath.Dir(outputfile)
+			}
+			g.Env = env
+			g.SideFiles = sideFiles
+			g.ContinueOnError = keepGoing
+			g.Timeout = directiveTimeout
+			g.Retries = retries
+			g.RetryDelay = retryDelay
+			g.Shell = shell
+			g.MathCommand = mathCommand
+			g.DefinitionLists = definitionLists
+			if len(replayfile) != 0 && len(recordfile) != 0 {
+				return prefix(prefixHTML, errors.New("--record and --replay cannot be used together"))
+			}
+			if len(replayfile) != 0 {
+				if g.Replay, err = readRecording(replayfile); err != nil {
+					return prefix(prefixHTML, err)
+				}
+			}
+			if len(recordfile) != 0 {
+				g.Record = new(html.Recording)
+			}
+			if len(templatefile) != 0 {
+				if g.Template, err = template.ParseFiles(templatefile); err != nil {
+					return prefix(prefixHTML, err)
+				}
+			}
+			err = g.Run()
+			if g.Record != nil {
+				if rerr := writeRecording(recordfile, g.Record); rerr != nil && err == nil {
+					err = rerr
+				}
+			}
+			if err != nil {
 				return prefix(prefixHTML, err)
 			}
 			return nil
@@ -124,8 +216,185 @@ specified, output is written to standard output.`,
 	htmlCmd.Flags().DurationVarP(&timeout, "timeout", "t", -1, "``timeout used to halt generator for long-running commands")
 	// Set string version of default value to be zero-value to prevent it from being printed by FlagUsages.
 	htmlCmd.Flags().Lookup("timeout").DefValue = "0"
+	htmlCmd.Flags().DurationVar(&directiveTimeout, "directive-timeout", 0, "``timeout for each directive's command")
+	htmlCmd.Flags().IntVar(&retries, "retries", 0, "``number of times to retry a failed directive's command")
+	htmlCmd.Flags().DurationVar(&retryDelay, "retry-delay", time.Second, "``delay before the first retry, doubled for each subsequent retry")
+	htmlCmd.Flags().StringVar(&shell, "shell", "", "``shell used to interpret the command lines of directives, such as sh")
+	htmlCmd.Flags().StringVar(&mathCommand, "math-command", "", "``command that converts TeX math on its standard input to HTML, such as MathML, instead of writing KaTeX markup")
+	htmlCmd.Flags().StringVar(&recordfile, "record", "", "``name of a file to record the results of directive commands to")
+	htmlCmd.Flags().StringVar(&replayfile, "replay", "", "``name of a file to replay the results of directive commands from, instead of running them")
+	htmlCmd.Flags().StringVar(&templatefile, "template", "", "``name of an html/template file executed with the output as .Body and the front matter as .Meta")
+	htmlCmd.Flags().BoolVar(&sideFiles, "side-files", false, "write binary output of directives to files beside the output, instead of embedding it")
+	htmlCmd.Flags().BoolVar(&definitionLists, "definition-lists", false, "write lists whose items are all labeled as definition lists")
+	htmlCmd.Flags().BoolVar(&expand, "expand", false, "expand <<name>> references to named directives before generating output")
+	htmlCmd.Flags().BoolVarP(&keepGoing, "keep-going", "k", false, "render failed directives as errors and continue generation")
+	htmlCmd.Flags().StringArrayVarP(&env, "env", "e", nil, "``environment entry of the form key=value passed to directive commands")
+
+	prefixDirectives := "(directives) "
+	directivesCmd := &cobra.Command{
+		Use:   "directives [input]",
+		Short: "List the directives in a mexdown source file without running them",
+		Long: `This command lists each directive in a mexdown source file, along with
+its line number, whether its command would be run, the resolved path
+of the command's executable, and the command's arguments. No commands
+are run. If any command cannot be run, such as when its executable is
+not found, this command exits with a non-zero status. If a recording is
+given with --replay, commands are looked up in the recording instead.
+
+If no input file is specified, input is read from standard input.`,
+		Args:                  cobra.MaximumNArgs(1),
+		DisableFlagsInUseLine: true,
+		SilenceUsage:          true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			src, name, err := open(args)
+			if err != nil {
+				return prefix(prefixDirectives, err)
+			}
+			defer src.Close()
+			ast, err := parser.ParseFile(name, src)
+			if err != nil {
+				return prefix(prefixDirectives, err)
+			}
+			g := html.Gen(ast)
+			g.Shell = shell
+			if len(args) != 0 {
+				g.Source = args[0]
+			}
+			if len(replayfile) != 0 {
+				if g.Replay, err = readRecording(replayfile); err != nil {
+					return prefix(prefixDirectives, err)
+				}
+			}
+			tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(tw, "INDEX\tLINE\tSTATUS\tPATH\tCOMMAND")
+			failed := 0
+			for _, d := range g.Directives() {
+				status := "run"
+				switch {
+				case d.Err != nil:
+					status = d.Err.Error()
+					failed++
+				case d.Replayed:
+					status = "replay"
+				case !d.Run:
+					status = "raw"
+				}
+				var paths, commands []string
+				for _, st := range d.Stages {
+					paths = append(paths, st.Path)
+					commands = append(commands, sq.Join(append(st.Env, st.Args...)...))
+				}
+				command := strings.Join(commands, " | ")
+				if d.Err != nil {
+					command = d.Command
+				}
+				line := strconv.Itoa(d.Line)
+				if d.Line == 0 {
+					line = "-" // inline directive
+				}
+				if d.File != name {
+					line = d.File + ":" + line
+				}
+				fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", d.Index, line, status, strings.Join(paths, " "), command)
+			}
+			tw.Flush()
+			if failed > 0 {
+				return prefix(prefixDirectives, fmt.Errorf("%d of the directives cannot be run", failed))
+			}
+			return nil
+		},
+	}
+
+	directivesCmd.Flags().StringVar(&shell, "shell", "", "``shell that would interpret the command lines of directives")
+	directivesCmd.Flags().StringVar(&replayfile, "replay", "", "``name of a file that the results of directive commands would be replayed from")
+
+	var outdir string
+	var noLine bool
+	prefixTangle := "(tangle) "
+	tangleCmd := &cobra.Command{
+		Use:   "tangle [input] [-d dir]",
+		Short: "Extract the files named by directives in a mexdown source file",
+		Long: `This command assembles the files named by the file attributes of
+directives in a mexdown source file, expanding <<name>> references to
+named directives, and writes them to the output directory. The name of
+each file written is printed to standard output. Files in languages
+that support them, such as C and Go, are given line directives mapping
+their lines back to the source file.
+
+If no input file is specified, input is read from standard input.`,
+		Args:                  cobra.MaximumNArgs(1),
+		DisableFlagsInUseLine: true,
+		SilenceUsage:          true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			src, source, err := open(args)
+			if err != nil {
+				return prefix(prefixTangle, err)
+			}
+			defer src.Close()
+			ast, err := parser.ParseFile(source, src)
+			if err != nil {
+				return prefix(prefixTangle, err)
+			}
+			if noLine {
+				source = ""
+			}
+			files, err := literate.Tangle(ast, source)
+			if err != nil {
+				return prefix(prefixTangle, err)
+			}
+			names := make([]string, 0, len(files))
+			for name := range files {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				path := filepath.Join(outdir, filepath.FromSlash(name))
+				if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+					return prefix(prefixTangle, err)
+				}
+				if err := ioutil.WriteFile(path, files[name], 0666); err != nil {
+					return prefix(prefixTangle, err)
+				}
+				fmt.Println(path)
+			}
+			return nil
+		},
+	}
+	tangleCmd.Flags().StringVarP(&outdir, "dir", "d", ".", "``directory to write the files to")
+	tangleCmd.Flags().BoolVar(&noLine, "no-line", false, "omit line directives mapping the files back to the source")
+
+	prefixTasks := "(tasks) "
+	tasksCmd := &cobra.Command{
+		Use:   "tasks [input]",
+		Short: "Summarize the progress of the tasks in a mexdown source file",
+		Long: `This command prints the number of tasks, which are list items with
+a checkbox such as "-[ ]" or "-[x]", that are done in a mexdown source
+file, out of the total number of tasks.
+
+If no input file is specified, input is read from standard input.`,
+		Args:                  cobra.MaximumNArgs(1),
+		DisableFlagsInUseLine: true,
+		SilenceUsage:          true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			src, name, err := open(args)
+			if err != nil {
+				return prefix(prefixTasks, err)
+			}
+			defer src.Close()
+			f, err := parser.ParseFile(name, src)
+			if err != nil {
+				return prefix(prefixTasks, err)
+			}
+			done, total := ast.CountTasks(f)
+			fmt.Printf("%d/%d tasks done\n", done, total)
+			return nil
+		},
+	}
 
+	rootCmd.AddCommand(directivesCmd)
 	rootCmd.AddCommand(htmlCmd)
+	rootCmd.AddCommand(tangleCmd)
+	rootCmd.AddCommand(tasksCmd)
 	if err := rootCmd.Execute(); err != nil {
 		os.Exit(1)
 	}
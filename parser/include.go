@@ -0,0 +1,181 @@
+// MIT License
+
+// Copyright (c) 2018 Akhil Indurti
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package parser
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"akhil.cc/mexdown/ast"
+)
+
+// ParseFile parses the source file named filename, and splices the statements of
+// any files it includes into the returned AST. If src is not nil, it is read as the
+// source instead of the named file, and filename is only used to resolve the paths
+// of included files and to record the origin of directives.
+//
+// A directive with an include attribute, and neither a command nor a body, is
+// replaced by the statements of the named file, whose path is relative to the
+// directory of the including file:
+// 	```{include=chapters/intro.xd}
+// 	```
+// Included files may include other files, but not themselves. Citations are merged
+// into the citations of the returned file, and it is an error for two files to cite
+// the same label with different sources. The front matter of included files is
+// ignored. The File field of each directive records the name of the file it
+// appears in.
+func ParseFile(filename string, src io.Reader) (*ast.File, error) {
+	in := &includer{cite: make(map[string]string), origin: make(map[string]string)}
+	f, err := in.parse(filename, src)
+	if err != nil {
+		return f, err
+	}
+	f.Cite = in.cite
+	return f, in.err()
+}
+
+// includer parses a file along with the files it includes.
+type includer struct {
+	stack  []string          // names of files being parsed, outermost first
+	cite   map[string]string // merged citations
+	origin map[string]string // name of the file that first cited each label
+	errors []string
+}
+
+func (in *includer) errorf(format string, v ...interface{}) {
+	in.errors = append(in.errors, fmt.Sprintf(format, v...))
+}
+
+func (in *includer) err() error {
+	if len(in.errors) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(in.errors, "\n") + "\n")
+}
+
+// parse parses the named file, reading src instead if it is not nil.
+func (in *includer) parse(filename string, src io.Reader) (*ast.File, error) {
+	if src == nil {
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		src = bytes.NewReader(b)
+	}
+	in.stack = append(in.stack, filename)
+	defer func() { in.stack = in.stack[:len(in.stack)-1] }()
+
+	f, err := Parse(src)
+	if err != nil {
+		// Prefix each error with the name of the file it occurred in.
+		for _, e := range strings.Split(err.Error(), "\n") {
+			if e != "" {
+				in.errorf("%s: %s", display(filename), e)
+			}
+		}
+	}
+	for label, src := range f.Cite {
+		if prev, ok := in.cite[label]; ok && prev != src {
+			in.errorf("%s: citation [%s]: %s conflicts with %s in %s", display(filename), label, src, prev, display(in.origin[label]))
+			continue
+		}
+		if _, ok := in.cite[label]; !ok {
+			in.cite[label], in.origin[label] = src, filename
+		}
+	}
+	f.List = in.splice(filename, f.List)
+	return f, nil
+}
+
+// splice returns list, which was parsed from the named file, with the
+// statements of included files in place of their include directives.
+func (in *includer) splice(filename string, list []ast.Stmt) []ast.Stmt {
+	spliced := make([]ast.Stmt, 0, len(list))
+	for _, st := range list {
+		if q, ok := st.(*ast.Quote); ok {
+			q.List = in.splice(filename, q.List)
+		}
+		d, ok := st.(*ast.Directive)
+		if !ok {
+			spliced = append(spliced, st)
+			continue
+		}
+		d.File = filename
+		name, ok := d.Attrs["include"]
+		if !ok {
+			spliced = append(spliced, st)
+			continue
+		}
+		if d.Command != "" || d.Raw != "" {
+			in.errorf("%s:%d: include directive cannot have a command or body", display(filename), d.Line)
+			continue
+		}
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(filepath.Dir(filename), name)
+		}
+		if chain := in.including(name); chain != nil {
+			in.errorf("%s:%d: include cycle: %s -> %s", display(filename), d.Line, strings.Join(chain, " -> "), name)
+			continue
+		}
+		g, err := in.parse(name, nil)
+		if err != nil {
+			in.errorf("%s:%d: %v", display(filename), d.Line, err)
+			continue
+		}
+		spliced = append(spliced, g.List...)
+	}
+	return spliced
+}
+
+// display returns the name of the file for use in errors,
+// which is "<stdin>" if it is empty.
+func display(filename string) string {
+	if filename == "" {
+		return "<stdin>"
+	}
+	return filename
+}
+
+// including returns the names of the files from the outermost file that
+// includes the named file to the file being parsed, if the named file is
+// being parsed.
+func (in *includer) including(name string) []string {
+	for i, s := range in.stack {
+		if sameFile(s, name) {
+			return in.stack[i:]
+		}
+	}
+	return nil
+}
+
+// sameFile reports whether a and b name the same file.
+func sameFile(a, b string) bool {
+	a, aerr := filepath.Abs(a)
+	b, berr := filepath.Abs(b)
+	return aerr == nil && berr == nil && a == b
+}
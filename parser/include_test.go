@@ -0,0 +1,114 @@
+// MIT License
+
+// Copyright (c) 2018 Akhil Indurti
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Tests for include.go
+package parser_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"akhil.cc/mexdown/parser"
+
+	"akhil.cc/mexdown/ast"
+	"github.com/sanity-io/litter"
+)
+
+// writeFiles writes files, keyed by name, into a temporary directory,
+// and returns the directory.
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "mexdown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestParseFile(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.xd":        "# Main\n```{include=ch/one.xd}\n```\n[a]:x\n",
+		"ch/one.xd":      "```cat\none\n```\n```{include=two.xd}\n```\n[a]:x\n",
+		"ch/two.xd":      "[b]:y\n",
+		"cite.xd":        "[a]:x\n```{include=ch/conflict.xd}\n```\n",
+		"ch/conflict.xd": "[a]:z\n",
+		"cycle.xd":       "```{include=ch/cycle.xd}\n```\n",
+		"ch/cycle.xd":    "```{include=../cycle.xd}\n```\n",
+		"missing.xd":     "```{include=nope.xd}\n```\n",
+		"body.xd":        "```{include=ch/two.xd}\nbody\n```\n",
+	})
+	defer os.RemoveAll(dir)
+	name := func(s string) string { return filepath.Join(dir, filepath.FromSlash(s)) }
+
+	got, err := parser.ParseFile(name("main.xd"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ast.File{
+		List: []ast.Stmt{
+			&ast.Header{NThorpe: 1, Text: ast.Text{Body: " Main"}},
+			&ast.Directive{Command: "cat\n", Raw: "one\n", Line: 1, File: name("ch/one.xd")},
+			&ast.Citation{Label: "b", Src: "y"},
+			&ast.Citation{Label: "a", Src: "x"},
+			&ast.Citation{Label: "a", Src: "x"},
+		},
+		Cite: map[string]string{"a": "x", "b": "y"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want\n%s\ngot\n%s", litter.Sdump(want), litter.Sdump(got))
+	}
+
+	for _, tt := range []struct {
+		name, err string
+	}{
+		{"cite.xd", name("ch/conflict.xd") + ": citation [a]: z conflicts with x in " + name("cite.xd")},
+		{"cycle.xd", name("ch/cycle.xd") + ":1: include cycle: " + name("cycle.xd") + " -> " + name("ch/cycle.xd") + " -> " + name("ch/cycle.xd/../../cycle.xd")},
+		{"missing.xd", name("missing.xd") + ":1: open " + name("nope.xd") + ": no such file or directory"},
+		{"body.xd", name("body.xd") + ":1: include directive cannot have a command or body"},
+	} {
+		_, err := parser.ParseFile(name(tt.name), nil)
+		if err == nil || strings.TrimSuffix(err.Error(), "\n") != tt.err {
+			t.Errorf("%s: want error %q, got %v", tt.name, tt.err, err)
+		}
+	}
+
+	src := strings.NewReader("```{include=" + name("ch/two.xd") + "}\n```\n")
+	if got, err := parser.ParseFile("", src); err != nil || got.Cite["b"] != "y" {
+		t.Errorf("from reader: want citation [b]: y, got %v (%v)", got.Cite, err)
+	}
+	src = strings.NewReader("```{include=" + name("ch/two.xd") + "}\nbody\n```\n")
+	if _, err := parser.ParseFile("", src); err == nil || err.Error() != "<stdin>:1: include directive cannot have a command or body\n" {
+		t.Errorf("from reader: want error naming <stdin>, got %v", err)
+	}
+}
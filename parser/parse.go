@@ -41,29 +41,121 @@
 //      rparen       = /* the Unicode code point U+0029 */ .
 //      underscore   = /* the Unicode code point U+005F */ .
 //      colon        = /* the Unicode code point U+003A */ .
+//      equals       = /* the Unicode code point U+003D */ .
+//      lbrace       = /* the Unicode code point U+007B */ .
+//      rbrace       = /* the Unicode code point U+007D */ .
+//      rangle       = /* the Unicode code point U+003E */ .
+//      bang         = /* the Unicode code point U+0021 */ .
+//      caret        = /* the Unicode code point U+005E */ .
+//      dollar       = /* the Unicode code point U+0024 */ .
+//      pipe         = /* the Unicode code point U+007C */ .
+//      slash        = /* the Unicode code point U+002F */ .
+//      backslash    = /* the Unicode code point U+005C */ .
+//      space        = /* the Unicode code point U+0020 */ .
+//      decimal_digit = "0" … "9" .
 //
 //      citation = lbrack text rbrack colon string .
+//      footnote = lbrack caret text rbrack colon text .
 //      paragraph = text .
-//      list_item = { tab } hyphen [ lbrack text rbrack ] text .
+//      list_item = { tab } hyphen [ octothorpe { decimal_digit } ] [ checkbox ] [ lbrack text rbrack ] text .
+//      checkbox = lbrack ( " " | "x" | "X" ) rbrack .
 //      list = { list_item newline } [ list_item ] .
 //      string = { unicode_char | newline } .
 //      command = unicode_char { unicode_char } .
-//      dirbody = backtick dirbody backtick | [ command ] newline string .
+//      value = unicode_char { unicode_char } | quoted_string .
+//      attribute = unicode_char { unicode_char } [ equals value ] .
+//      attributes = lbrace { attribute } rbrace .
+//      dirbody = backtick dirbody backtick | [ attributes ] [ command ] newline string .
 //      directive = backtick backtick backtick dirbody backtick backtick backtick .
 //      text = unicode_char { unicode_char } |
 //             lbrack text rbrack lparen text rparen |
+//             bang lbrack text rbrack [ lparen text rparen ] |
+//             lbrack caret text rbrack |
 //             asterisk text asterisk |
 //             asterisk asterisk text asterisk asterisk |
 //             underscore text underscore |
 //             hyphen hyphen text hyphen hyphen |
-//             backtick text backtick .
+//             backtick text backtick |
+//             backtick bang lbrace command rbrace text backtick |
+//             dollar text dollar |
+//             dollar dollar text dollar dollar |
+//             text line_break text .
+//      line_break = ( backslash | space space { space } ) newline .
 //      header = octothorpe { octothorpe } text .
-//      statement = header | directive | list | paragraph | citation .
-//      source_file = { statement [ newline ] [ newline ] } .
+//      table_row = pipe { text pipe } [ text ] .
+//      table = table_row { newline table_row } .
+//      quote_line = rangle { unicode_char } .
+//      quote = quote_line { newline quote_line } .
+//      rule = hyphen hyphen hyphen { hyphen } .
+//      page_break = equals equals equals { equals } .
+//      comment = slash slash { unicode_char } |
+//                slash asterisk { unicode_char | newline } asterisk slash .
+//      statement = header | directive | list | paragraph | citation | footnote | table | quote |
+//                  rule | page_break | comment .
+//      meta = unicode_char { unicode_char } colon { unicode_char } .
+//      front_matter = hyphen hyphen hyphen newline { meta newline } hyphen hyphen hyphen newline .
+//      source_file = [ front_matter ] { statement [ newline ] [ newline ] } .
+//
+// Attributes are separated by spaces, and a value containing spaces may be quoted
+// with either single or double quotes, as in the Bourne shell. Braces only hold
+// attributes if they hold at least one, each of whose names consists of letters,
+// digits, hyphens, underscores, periods and colons, and the closing brace is
+// followed by a space or the end of the line. Otherwise, as in "```{ a; b; } | c",
+// they are part of the command.
+//
+// The text following the angle bracket of each line of a quote, along with one
+// optional space, forms a source file of its own, whose statements are nested
+// in the quote. Quotes may therefore be nested by repeating the angle bracket.
+//
+// A code span whose text begins with an exclamation mark and a command in braces,
+// as in "`!{date +%Y}`", is an inline directive. Unlike the attributes of a directive,
+// the braces hold the command itself, which receives the rest of the span on its
+// standard input. A code span beginning with braces alone, as in "`{"a": 1}`", is
+// ordinary code.
+//
+// A line of a paragraph that ends in a backslash, or in two or more spaces, is
+// followed by a hard line break, unless it is the paragraph's last line.
+//
+// The text of inline math, between single dollar signs, must not begin or end with
+// a space, and its closing dollar sign must not be followed by a digit. Neither inline
+// nor display math, which is between double dollar signs, is formatted.
+//
+// A table row whose cells each consist of one or more hyphens, optionally preceded
+// or followed by a colon, is a delimiter row. The rows preceding the first delimiter
+// row form the table's header, and the colons set the alignment of each column:
+// on the left for left alignment, on both sides for center alignment, and on the
+// right for right alignment. A pipe inside a cell must be escaped. A line with no
+// cells, such as a lone pipe, continues the table without adding a row to it.
+//
+// A line of three or more hyphens is a horizontal rule rather than a list item or
+// strikethrough text, and a line of three or more equals signs is a page break.
+// Either may be followed by spaces.
+//
+// A list item whose hyphen is followed by an octothorpe is numbered, and its
+// octothorpe may be followed by the number to start counting from, as in "-#3".
+// The label of a list item, in brackets, is formatted like other text, and may
+// contain balanced brackets of its own, as in "-[[a link](src)]".
+//
+// A list item whose hyphen, or number, is followed by "[ ]" or "[x]" is a task,
+// whose checkbox may be followed by a label. A label consisting of a single space
+// or x is therefore read as a checkbox instead.
+//
+// A comment begins at the start of a line, with two slashes for a line comment, or
+// with a slash and an asterisk for a block comment, which continues up to the next
+// asterisk and slash. Comments end the list preceding them, and are not part of the
+// document's text, so the lines of a paragraph on either side of them are joined, and
+// the comments follow the paragraph. A line starting with slashes may be escaped, as
+// in "\//".
+//
+// Front matter must begin on the first line of the file. Blank lines and lines
+// starting with an octothorpe are ignored, and surrounding spaces and quotes are
+// trimmed from values. Unless each of the other lines up to the closing line is of
+// the form key: value, and there is at least one, the opening line is a horizontal
+// rule instead.
 //
 // In the relevant context, the following characters are escaped (in Go syntax):
 //
-//      '\\', '#', '`', '-', '*', '[', ']', '(', ')', '_'
+//      '\\', '#', '`', '-', '*', '[', ']', '(', ')', '_', '|', '>', '!', '$', '=', '/'
 //
 package parser // import "akhil.cc/mexdown/parser"
 
@@ -72,7 +164,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strconv"
 	"strings"
+	"unicode"
 	"unicode/utf8"
 
 	"akhil.cc/mexdown/ast"
@@ -95,31 +189,68 @@ func Parse(src io.Reader) (f *ast.File, err error) {
 		b:      bufio.NewReader(src),
 		cite:   make(map[string]string),
 	}
-	// source_file = { statement [ newline ] [ newline ] } .
-	f = &ast.File{List: []ast.Stmt{}}
+	// source_file = [ front_matter ] { statement [ newline ] [ newline ] } .
+	f = &ast.File{}
 	p.next()
+	f.Meta = p.frontMatter()
+	f.List = p.stmts()
+	f.Cite = p.cite
+	var es strings.Builder
+	for _, e := range p.errors {
+		es.WriteString(e.Error())
+		es.WriteString("\n")
+	}
+	if len(p.errors) > 0 {
+		err = errors.New(es.String())
+	}
+	return f, err
+}
+
+// stmts parses statements until the end of the input.
+func (p *parser) stmts() []ast.Stmt {
+	list := []ast.Stmt{}
 	for p.r != eof || p.st != nil {
-		f.List = append(f.List, p.stmt())
+		list = append(list, p.stmt())
+	}
+	// move a paragraph that follows comments ahead of them,
+	// so that it is combined with the paragraph preceding them
+	for i := range list {
+		if _, ok := list[i].(*ast.Paragraph); !ok {
+			continue
+		}
+		k := i + 1
+		for k < len(list) {
+			if _, ok := list[k].(*ast.Comment); !ok {
+				break
+			}
+			k++
+		}
+		if k == i+1 || k == len(list) {
+			continue
+		}
+		if pk, ok := list[k].(*ast.Paragraph); ok {
+			copy(list[i+2:k+1], list[i+1:k])
+			list[i+1] = pk
+		}
 	}
-	f.Cite = p.cite
 	// combine consecutive paragraphs
-	for i, j := 0, 1; i < len(f.List) && j < len(f.List); i, j = i+1, j+1 {
-		pi, _ := f.List[i].(*ast.Paragraph)
-		pj, _ := f.List[j].(*ast.Paragraph)
+	for i, j := 0, 1; i < len(list) && j < len(list); i, j = i+1, j+1 {
+		pi, _ := list[i].(*ast.Paragraph)
+		pj, _ := list[j].(*ast.Paragraph)
 		// validate that they are not empty
 		sub := 0
 		if pi != nil && strings.TrimSpace(pi.Body) == "" {
 			// delete
-			copy(f.List[i:], f.List[i+1:])
-			f.List[len(f.List)-1] = nil
-			f.List = f.List[:len(f.List)-1]
+			copy(list[i:], list[i+1:])
+			list[len(list)-1] = nil
+			list = list[:len(list)-1]
 			sub++
 		}
 		if pj != nil && strings.TrimSpace(pj.Body) == "" {
 			// delete
-			copy(f.List[j-sub:], f.List[j-sub+1:])
-			f.List[len(f.List)-1] = nil
-			f.List = f.List[:len(f.List)-1]
+			copy(list[j-sub:], list[j-sub+1:])
+			list[len(list)-1] = nil
+			list = list[:len(list)-1]
 			sub++
 		}
 		if sub > 0 {
@@ -127,36 +258,40 @@ func Parse(src io.Reader) (f *ast.File, err error) {
 		} else if pi != nil && pj != nil {
 			// body
 			par := &ast.Paragraph{Body: pi.Body + pj.Body, Format: pi.Format}
-			f.List[i] = par
+			list[i] = par
 			// remove jth
-			copy(f.List[j:], f.List[j+1:])
-			f.List[len(f.List)-1] = nil
-			f.List = f.List[:len(f.List)-1]
+			copy(list[j:], list[j+1:])
+			list[len(list)-1] = nil
+			list = list[:len(list)-1]
 			// subtract indices
 			i, j = i-1, j-1
 		}
 	}
 	// Parse formats for paragraph
-	for i := range f.List {
-		pi, _ := f.List[i].(*ast.Paragraph)
+	for i := range list {
+		pi, _ := list[i].(*ast.Paragraph)
 		if pi != nil {
-			rdr := io.MultiReader(strings.NewReader(pi.Body+string(eof)+string(p.r)), p.b)
-			p.b = bufio.NewReader(rdr)
-			p.next()
+			p.unread(pi.Body + string(rune(eof)))
 			txt := p.text(eof)
 			pi.Body = txt.Body
 			pi.Format = txt.Format
 		}
+		// Parse formats for footnotes
+		if fn, ok := list[i].(*ast.Footnote); ok {
+			p.unread(fn.Text.Body + string(rune(eof)))
+			fn.Text = p.text(eof)
+		}
+		// Parse formats for table cells
+		if t, ok := list[i].(*ast.Table); ok {
+			for _, row := range t.Rows {
+				for j := range row.Cells {
+					p.unread(row.Cells[j].Text.Body + string(rune(eof)))
+					row.Cells[j].Text = p.text(eof)
+				}
+			}
+		}
 	}
-	var es strings.Builder
-	for _, e := range p.errors {
-		es.WriteString(e.Error())
-		es.WriteString("\n")
-	}
-	if len(p.errors) > 0 {
-		err = errors.New(es.String())
-	}
-	return f, err
+	return list
 }
 
 const eof = -1
@@ -165,6 +300,7 @@ type parser struct {
 	errors []error
 	b      *bufio.Reader
 	r      rune
+	nline  int // number of newlines read
 	st     ast.Stmt
 	cite   map[string]string
 }
@@ -183,18 +319,90 @@ func (p *parser) stmt() ast.Stmt {
 		return p.directive()
 	case '[':
 		return p.citation()
+	case '|':
+		return p.table()
+	case '>':
+		return p.quote()
 	case '-':
+		if r := p.rule(""); r != nil {
+			return r
+		}
 		l, st := p.list()
 		if l.Items == nil {
 			return st
 		}
 		p.st = st
 		return l
+	case '=':
+		if r := p.rule(""); r != nil {
+			return r
+		}
+		return p.paragraph("")
+	case '/':
+		if c := p.comment(); c != nil {
+			return c
+		}
+		return p.paragraph("")
 	default:
 		return p.paragraph("")
 	}
 }
 
+// rule = hyphen hyphen hyphen { hyphen } .
+// page_break = equals equals equals { equals } .
+//
+// rule returns the horizontal rule or page break on the current line,
+// whose first runes before have already been read. If the line is
+// neither, rule returns nil and leaves the line unread.
+func (p *parser) rule(before string) ast.Stmt {
+	l := before + p.line(nil)
+	switch s := strings.TrimRight(l, " \t\n"); {
+	case len(s) >= 3 && strings.Trim(s, "-") == "":
+		return &ast.Rule{}
+	case len(s) >= 3 && strings.Trim(s, "=") == "":
+		return &ast.PageBreak{}
+	}
+	p.unread(l)
+	return nil
+}
+
+// comment = slash slash { unicode_char } |
+//           slash asterisk { unicode_char | newline } asterisk slash .
+//
+// comment returns the comment starting at the current rune, or nil if
+// there is none. Text following a block comment on the same line is
+// left unread.
+func (p *parser) comment() *ast.Comment {
+	switch b, _ := p.b.Peek(1); string(b) {
+	case "/":
+		p.next()
+		p.next()
+		return &ast.Comment{Text: strings.TrimSuffix(p.line(nil), "\n")}
+	case "*":
+		p.next()
+		p.next()
+		var buf strings.Builder
+		for {
+			if p.r == eof {
+				p.errorf("Block comment is not terminated: /*%s", buf.String())
+				break
+			}
+			if b, _ := p.b.Peek(1); p.r == '*' && string(b) == "/" {
+				p.next()
+				p.next()
+				break
+			}
+			buf.WriteRune(p.r)
+			p.next()
+		}
+		if rest := p.line(nil); strings.TrimSpace(rest) != "" {
+			p.unread(rest)
+		}
+		return &ast.Comment{Text: buf.String(), Block: true}
+	}
+	return nil
+}
+
 // header = octothorpe { octothorpe } text .
 func (p *parser) header() *ast.Header {
 	var hdr ast.Header
@@ -224,9 +432,19 @@ func (p *parser) text(end rune) ast.Text {
 		format []ast.Format
 		buf    strings.Builder
 		inRaw  bool
+		breaks []ast.Format // hard line breaks
+		nspace int          // number of spaces preceding the current rune
 	)
 	// maintain a stack of tokens that correspond to formatting tags inside text
 	for p.r != end && p.r != eof {
+		if p.r == '\n' && nspace >= 2 {
+			breaks = append(breaks, ast.Format{Kind: ast.LineBreak, Beg: pos - nspace, End: pos - 1})
+		}
+		if p.r == ' ' {
+			nspace++
+		} else {
+			nspace = 0
+		}
 		switch p.r {
 		case '*':
 			buf.WriteRune(p.r)
@@ -246,9 +464,16 @@ func (p *parser) text(end rune) ast.Text {
 		case '_':
 			buf.WriteRune(p.r)
 			tokens = append(tokens, token{"_", pos})
+		case '!':
+			buf.WriteRune(p.r)
+			tokens = append(tokens, token{"!", pos})
 		case '[':
 			buf.WriteRune(p.r)
-			tokens = append(tokens, token{"[", pos})
+			if len(tokens) > 0 && tokens[len(tokens)-1] == (token{"!", pos - 1}) {
+				tokens[len(tokens)-1] = token{"![", pos}
+			} else {
+				tokens = append(tokens, token{"[", pos})
+			}
 		case ']':
 			buf.WriteRune(p.r)
 			tokens = append(tokens, token{"]", pos})
@@ -267,6 +492,13 @@ func (p *parser) text(end rune) ast.Text {
 			buf.WriteRune(p.r)
 			tokens = append(tokens, token{"`", pos})
 			inRaw = !inRaw
+		case '$':
+			buf.WriteRune(p.r)
+			if len(tokens) > 0 && tokens[len(tokens)-1] == (token{"$", pos - 1}) {
+				tokens[len(tokens)-1] = token{"$$", pos}
+			} else {
+				tokens = append(tokens, token{"$", pos})
+			}
 		case '-':
 			buf.WriteRune(p.r)
 			s := "-"
@@ -280,6 +512,9 @@ func (p *parser) text(end rune) ast.Text {
 			tokens = append(tokens, token{s, pos})
 		case '\\':
 			p.next()
+			if p.r == '\n' {
+				breaks = append(breaks, ast.Format{Kind: ast.LineBreak, Beg: pos, End: pos})
+			}
 			if !escapable(p.r) || inRaw {
 				pos++
 				buf.WriteRune('\\')
@@ -301,6 +536,8 @@ func (p *parser) text(end rune) ast.Text {
 	//  if there is an odd number of backtick characters, then the last backtick
 	//    character is not a delimeter for a raw tag
 	//  you can append these format asts then
+	//  a raw span beginning with a bang and a braced command is an inline directive
+	runes := []rune(buf.String())
 	ib := -1
 	for i := 0; i < len(tokens); i++ {
 		if tokens[i].s == "`" {
@@ -308,8 +545,12 @@ func (p *parser) text(end rune) ast.Text {
 				ib = i
 			}
 			if ib < i {
+				kind := ast.Raw
+				if _, _, ok := ast.SplitInline(string(runes[tokens[ib].pos+1 : tokens[i].pos])); ok {
+					kind = ast.InlineDirective
+				}
 				format = append(format, ast.Format{
-					Kind: ast.Raw,
+					Kind: kind,
 					Beg:  tokens[ib].pos,
 					End:  tokens[i].pos,
 				})
@@ -322,6 +563,58 @@ func (p *parser) text(end rune) ast.Text {
 		}
 	}
 
+	// math has the next highest precedence, so eliminate everything between
+	// math delimiters as well, starting with display math. To avoid mistaking
+	// amounts of money for math, an inline span must not begin or end with a
+	// space, and must not be followed by a digit.
+	space := func(i int) bool { return i < 0 || i >= len(runes) || unicode.IsSpace(runes[i]) }
+	digit := func(i int) bool { return 0 <= i && i < len(runes) && unicode.IsDigit(runes[i]) }
+	for _, delim := range [...]string{"$$", "$"} {
+		ib := -1
+		for i := 0; i < len(tokens); i++ {
+			if tokens[i].s != delim {
+				continue
+			}
+			if ib == -1 {
+				if delim == "$$" || !space(tokens[i].pos+1) {
+					ib = i
+				}
+				continue
+			}
+			if delim == "$" && (space(tokens[i].pos-1) || digit(tokens[i].pos+1)) {
+				continue
+			}
+			kind := ast.Math
+			if delim == "$$" {
+				kind = ast.DisplayMath
+			}
+			format = append(format, ast.Format{
+				Kind: kind,
+				Beg:  tokens[ib].pos,
+				End:  tokens[i].pos,
+			})
+			disp := len(tokens)
+			tokens = append(tokens[:ib], tokens[i+1:]...)
+			disp -= len(tokens)
+			i -= disp
+			ib = -1
+		}
+	}
+
+	// a hard line break is only kept if it is followed by more text,
+	// and is not inside code or math, which are the only formats so far
+	for _, b := range breaks {
+		keep := strings.TrimSpace(string(runes[b.End+1:])) != ""
+		for _, f := range format {
+			if f.Beg < b.Beg && b.End < f.End {
+				keep = false
+			}
+		}
+		if keep {
+			format = append(format, b)
+		}
+	}
+
 	// assumes slice doesn't have high-prec operators like citations or raw quotes.
 	lowprec := func(tokens []token) {
 		idx := []int{-1, -1, -1, -1, -1}
@@ -399,10 +692,22 @@ func (p *parser) text(end rune) ast.Text {
 
 	// now you know that you don’t have to check for raw. only problem now is citation
 	// on a second pass, for each citation, parse its inner section. remove all of those tokens.
+	// An image is a citation preceded by an exclamation mark, and a footnote
+	// reference is a citation without a source whose label starts with a
+	// caret. Neither of their texts are formatted.
+	cite := func(open, end token) ast.Format {
+		switch {
+		case open.s == "![":
+			return ast.Format{Kind: ast.Image, Beg: open.pos - 1, End: end.pos}
+		case end.s == "]" && open.pos+1 < end.pos && runes[open.pos+1] == '^':
+			return ast.Format{Kind: ast.FootnoteRef, Beg: open.pos, End: end.pos}
+		}
+		return ast.Format{Kind: ast.Cite, Beg: open.pos, End: end.pos}
+	}
 	cit := []int{-1, -1, -1, -1}
 	for i := 0; i < len(tokens); i++ {
 		switch tokens[i].s {
-		case "[":
+		case "[", "![":
 			if cit[0] == -1 {
 				cit[0] = i
 			}
@@ -417,14 +722,12 @@ func (p *parser) text(end rune) ast.Text {
 				cit[1] = i
 			}
 			if cit[0] != -1 {
-				format = append(format, ast.Format{
-					Kind: ast.Cite,
-					Beg:  tokens[cit[0]].pos,
-					End:  tokens[i].pos,
-				})
+				f := cite(tokens[cit[0]], tokens[i])
+				format = append(format, f)
 				// we can now parse the inside of the brackets
-				subtok := tokens[cit[0] : i+1]
-				lowprec(subtok)
+				if f.Kind == ast.Cite {
+					lowprec(tokens[cit[0] : i+1])
+				}
 				disp := len(tokens)
 				tokens = append(tokens[:cit[0]], tokens[i+1:]...)
 				disp -= len(tokens)
@@ -444,13 +747,10 @@ func (p *parser) text(end rune) ast.Text {
 				cit[3] = i
 			}
 			if cit[0] != -1 && cit[2] != -1 {
-				format = append(format, ast.Format{
-					Kind: ast.Cite,
-					Beg:  tokens[cit[0]].pos,
-					End:  tokens[i].pos,
-				})
-				subtok := tokens[cit[0] : cit[2]+1]
-				lowprec(subtok)
+				format = append(format, cite(tokens[cit[0]], tokens[i]))
+				if tokens[cit[0]].s == "[" {
+					lowprec(tokens[cit[0] : cit[2]+1])
+				}
 				disp := len(tokens)
 				tokens = append(tokens[:cit[0]], tokens[i+1:]...)
 				disp -= len(tokens)
@@ -462,11 +762,7 @@ func (p *parser) text(end rune) ast.Text {
 		}
 	}
 	if cit[0] > -1 && cit[2] > cit[0] {
-		format = append(format, ast.Format{
-			Kind: ast.Cite,
-			Beg:  tokens[cit[0]].pos,
-			End:  tokens[cit[2]].pos - 1,
-		})
+		format = append(format, cite(tokens[cit[0]], token{pos: tokens[cit[2]].pos - 1}))
 	}
 	// in the last pass emit everything else
 	lowprec(tokens)
@@ -476,9 +772,10 @@ func (p *parser) text(end rune) ast.Text {
 	}
 }
 
-// dirbody = backtick dirbody backtick | [ command ] newline string .
+// dirbody = backtick dirbody backtick | [ attributes ] [ command ] newline string .
 // directive = backtick backtick backtick dirbody backtick backtick backtick .
 func (p *parser) directive() ast.Stmt {
+	line := p.nline + 1
 	if p.next() != '`' {
 		return p.paragraph("`")
 	}
@@ -490,6 +787,16 @@ func (p *parser) directive() ast.Stmt {
 		prefix += "`"
 	}
 	cmd := strings.TrimSuffix(p.line(nil), "\n")
+	var attrs map[string]string
+	if strings.HasPrefix(cmd, "{") {
+		var err error
+		if attrs, cmd, err = attributes(cmd); err == errNotAttributes {
+			attrs = nil
+		} else if err != nil {
+			p.errorf("Invalid directive attributes: %s: %v", cmd, err)
+		}
+		cmd = strings.TrimSpace(cmd)
+	}
 	if cmd != "" {
 		cmd += "\n"
 	}
@@ -515,7 +822,88 @@ func (p *parser) directive() ast.Stmt {
 	return &ast.Directive{
 		Command: cmd,
 		Raw:     buf.String(),
+		Line:    line,
+		Attrs:   attrs,
+	}
+}
+
+// errNotAttributes is returned by attributes if the braces at the start of
+// a directive's line belong to its command, as in a shell group.
+var errNotAttributes = errors.New("not attributes")
+
+// attributes = lbrace { attribute } rbrace .
+//
+// attributes parses the attributes at the start of s,
+// and returns the remainder of s following them.
+func attributes(s string) (attrs map[string]string, rest string, err error) {
+	attrs = make(map[string]string)
+	i := 1
+	for {
+		for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+			i++
+		}
+		if i == len(s) {
+			return attrs, s, errors.New("missing closing brace")
+		}
+		if s[i] == '}' {
+			if len(attrs) == 0 || i+1 < len(s) && s[i+1] != ' ' && s[i+1] != '\t' {
+				return nil, s, errNotAttributes
+			}
+			return attrs, s[i+1:], nil
+		}
+		beg := i
+		for i < len(s) && !strings.ContainsRune(" \t=}", rune(s[i])) {
+			if !isAttributeName(s[i]) {
+				return nil, s, errNotAttributes
+			}
+			i++
+		}
+		key, val := s[beg:i], ""
+		if key == "" {
+			return attrs, s, errors.New("missing attribute name")
+		}
+		if i < len(s) && s[i] == '=' {
+			if val, i, err = value(s, i+1); err != nil {
+				return attrs, s, err
+			}
+		}
+		attrs[key] = val
+	}
+}
+
+// isAttributeName reports whether c may be part of an attribute's name.
+func isAttributeName(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '_' || c == '.' || c == ':' || c >= utf8.RuneSelf
+}
+
+// value = unicode_char { unicode_char } | quoted_string .
+//
+// value parses the attribute value starting at s[i], and returns
+// the index of the byte following it.
+func value(s string, i int) (string, int, error) {
+	var buf strings.Builder
+	var quote byte
+	for ; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote == 0 && (c == ' ' || c == '\t' || c == '}'):
+			return buf.String(), i, nil
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote != 0 && c == quote:
+			quote = 0
+		case c == '\\' && quote != '\'' && i+1 < len(s):
+			i++
+			buf.WriteByte(s[i])
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	if quote != 0 {
+		return buf.String(), i, errors.New("unterminated quoted string")
 	}
+	return buf.String(), i, nil
 }
 
 // list = { list_item newline } [ list_item ] .
@@ -535,11 +923,12 @@ func (p *parser) list() (*ast.List, ast.Stmt) {
 	}
 	if len(li.Text.Body) > 0 {
 		if li.Text.Body[0] == '-' {
-			return &l, p.paragraph(li.Text.Body)
+			if r := p.rule(li.Text.Body); r != nil {
+				return &l, r
+			}
+			return &l, p.paragraph("")
 		}
-		rdr := io.MultiReader(strings.NewReader(li.Text.Body+string(p.r)), p.b)
-		p.b = bufio.NewReader(rdr)
-		p.next()
+		p.unread(li.Text.Body)
 	}
 	return &l, p.stmt()
 }
@@ -547,7 +936,7 @@ func (p *parser) list() (*ast.List, ast.Stmt) {
 var notList = errors.New("not list item")
 
 // returning nil means paragraph
-// list_item = { tab } hyphen [ lbrack text rbrack ] text .
+// list_item = { tab } hyphen [ octothorpe { decimal_digit } ] [ checkbox ] [ lbrack text rbrack ] text .
 func (p *parser) listItem() (ast.ListItem, error) {
 	var li ast.ListItem
 	for p.r == '\t' {
@@ -569,11 +958,57 @@ func (p *parser) listItem() (ast.ListItem, error) {
 		li.Text.Body += "-"
 		return li, notList
 	}
+	if p.r == '#' {
+		li.Ordered = true
+		var digits strings.Builder
+		for p.next(); '0' <= p.r && p.r <= '9'; p.next() {
+			digits.WriteRune(p.r)
+		}
+		if digits.Len() > 0 {
+			n, err := strconv.Atoi(digits.String())
+			if err != nil {
+				p.errorf("Invalid list start number: %s", digits.String())
+			} else {
+				li.Start, li.HasStart = n, true
+			}
+		}
+	}
+	// checkbox = lbrack ( " " | "x" | "X" ) rbrack .
 	if p.r == '[' {
-		p.next()
-		li.Label = p.str(func(r rune) bool { return r == ']' }, func(r rune) bool { return r == '\\' || r == ']' }, nil)
+		switch b, _ := p.b.Peek(2); string(b) {
+		case " ]":
+			li.Check = ast.CheckOpen
+		case "x]", "X]":
+			li.Check = ast.CheckDone
+		}
+		if li.Check != ast.CheckNone {
+			p.next()
+			p.next()
+			p.next()
+		}
+	}
+	// The label is formatted along with the item's text, so escapes are kept,
+	// and brackets may be nested in it, as in "-[[a link](x)]".
+	var label strings.Builder
+	if p.r == '[' {
+		depth := 0
+		for p.next(); p.r != eof && (p.r != ']' || depth > 0); p.next() {
+			switch p.r {
+			case '\\':
+				label.WriteRune(p.r)
+				p.next()
+			case '[':
+				depth++
+			case ']':
+				depth--
+			}
+			if p.r == eof {
+				break
+			}
+			label.WriteRune(p.r)
+		}
 		if p.r != ']' {
-			p.errorf("List item's label does not have a closing bracket: %s", "["+li.Label)
+			p.errorf("List item's label does not have a closing bracket: %s", "["+label.String())
 		}
 		p.next()
 	}
@@ -582,29 +1017,35 @@ func (p *parser) listItem() (ast.ListItem, error) {
 	for {
 		l := strings.TrimSuffix(p.line(nil), "\n") // w/o '\n' at the end
 		tr := strings.TrimSpace(l)
-		if len(tr) == 0 || tr[0] == '-' {
-			// new list or new item
-			ln += string(eof) + l + "\n"
+		if len(tr) == 0 || tr[0] == '-' || strings.HasPrefix(l, "//") || strings.HasPrefix(l, "/*") {
+			// new list, new item, or comment
+			ln += string(rune(eof)) + l + "\n"
 			break
 		}
 		// same item
 		ln += " " + l
 	}
-	rdr := io.MultiReader(strings.NewReader(ln+string(p.r)), p.b)
-	p.b = bufio.NewReader(rdr)
-	p.next()
+	if label.Len() > 0 {
+		lp := &parser{
+			b:     bufio.NewReader(strings.NewReader(label.String())),
+			nline: p.nline,
+			cite:  p.cite,
+		}
+		lp.next()
+		li.Label = lp.text(eof)
+		p.errors = append(p.errors, lp.errors...)
+	}
+	p.unread(ln)
 	li.Text = p.text(eof)
 	return li, nil
 }
 
 func (p *parser) paragraph(before string) *ast.Paragraph {
 	if len(before) > 0 {
-		rdr := io.MultiReader(strings.NewReader(before+string(p.r)), p.b)
-		p.b = bufio.NewReader(rdr)
-		p.next()
+		p.unread(before)
 	}
 	b := p.line(nil)
-	b += p.str(func(r rune) bool { return r != '\n' }, func(r rune) bool { return r == '\\' }, nil)
+	b += p.str(func(r rune) bool { return r != '\n' }, nil, nil)
 	par := ast.Paragraph{
 		Format: nil,
 		Body:   b,
@@ -618,9 +1059,21 @@ func (p *parser) next() rune {
 		r = eof
 	}
 	p.r = r
+	if r == '\n' {
+		p.nline++
+	}
 	return r
 }
 
+// unread pushes s back onto the input, so that it is read
+// again starting from its first rune, followed by the current rune.
+func (p *parser) unread(s string) {
+	s += string(p.r)
+	p.nline -= strings.Count(s, "\n")
+	p.b = bufio.NewReader(io.MultiReader(strings.NewReader(s), p.b))
+	p.next()
+}
+
 // str reads all input up to, but not including end.
 // Does not advance pointer in input past end.
 // Calls f to determine whether or not to write.
@@ -655,13 +1108,168 @@ func (p *parser) str(end func(rune) bool, esc, f func(rune) bool) string {
 
 func escapable(r rune) bool {
 	switch r {
-	case '\\', '#', '`', '-', '*', '[', ']', '(', ')', '_':
+	case '\\', '#', '`', '-', '*', '[', ']', '(', ')', '_', '|', '>', '!', '$', '=', '/':
 		return true
 	}
 	return false
 }
 
+// quote = quote_line { newline quote_line } .
+func (p *parser) quote() *ast.Quote {
+	var buf strings.Builder
+	line := p.nline
+	for p.r == '>' {
+		if p.next() == ' ' {
+			p.next()
+		}
+		buf.WriteString(p.line(nil))
+	}
+	q := &parser{
+		b:     bufio.NewReader(strings.NewReader(buf.String())),
+		nline: line,
+		cite:  p.cite,
+	}
+	q.next()
+	quote := &ast.Quote{List: q.stmts()}
+	p.errors = append(p.errors, q.errors...)
+	return quote
+}
+
+// table = table_row { newline table_row } .
+//
+// The text of each cell is formatted once the whole source has been parsed.
+func (p *parser) table() *ast.Table {
+	t := new(ast.Table)
+	for p.r == '|' {
+		cells := cells(strings.TrimSuffix(p.line(nil), "\n"))
+		if align, ok := delimiter(cells); ok && t.Align == nil {
+			t.Align = align
+			t.NHeader = len(t.Rows)
+			continue
+		}
+		if len(cells) == 0 {
+			continue
+		}
+		var row ast.TableRow
+		for _, c := range cells {
+			row.Cells = append(row.Cells, ast.TableCell{Text: ast.Text{Body: c}})
+		}
+		t.Rows = append(t.Rows, row)
+	}
+	return t
+}
+
+// table_row = pipe { text pipe } [ text ] .
+//
+// cells splits the table row l into the trimmed text of its cells,
+// which are separated by unescaped pipes.
+func cells(l string) []string {
+	var cells []string
+	beg := 1
+	for i := 1; i < len(l); i++ {
+		switch l[i] {
+		case '\\':
+			i++
+		case '|':
+			cells = append(cells, strings.TrimSpace(l[beg:i]))
+			beg = i + 1
+		}
+	}
+	if rest := strings.TrimSpace(l[beg:]); rest != "" {
+		cells = append(cells, rest)
+	}
+	return cells
+}
+
+// delimiter reports whether cells form a delimiter row,
+// and if so, returns the alignment of each column.
+func delimiter(cells []string) ([]ast.Align, bool) {
+	if len(cells) == 0 {
+		return nil, false
+	}
+	align := make([]ast.Align, len(cells))
+	for i, c := range cells {
+		left, right := strings.HasPrefix(c, ":"), strings.HasSuffix(c, ":")
+		c = strings.TrimSuffix(strings.TrimPrefix(c, ":"), ":")
+		if c == "" || strings.Trim(c, "-") != "" {
+			return nil, false
+		}
+		switch {
+		case left && right:
+			align[i] = ast.AlignCenter
+		case left:
+			align[i] = ast.AlignLeft
+		case right:
+			align[i] = ast.AlignRight
+		}
+	}
+	return align, true
+}
+
+// front_matter = hyphen hyphen hyphen newline { meta newline } hyphen hyphen hyphen newline .
+//
+// frontMatter returns nil, leaving the input unread, unless the first line of the
+// file is followed by at least one line of the form key: value, and every other
+// line up to the closing line is blank or a comment.
+func (p *parser) frontMatter() map[string]string {
+	if p.r != '-' {
+		return nil
+	}
+	if b, _ := p.b.Peek(3); string(b) != "--\n" && string(b) != "--\r" {
+		return nil
+	}
+	raw := p.line(nil)
+	if strings.TrimSuffix(raw, "\n") != "---" {
+		p.unread(raw)
+		return nil
+	}
+	var lines []string
+	closed := false
+	for p.r != eof {
+		l := p.line(nil)
+		raw += l
+		l = strings.TrimSuffix(l, "\n")
+		if l == "---" {
+			closed = true
+			break
+		}
+		if strings.TrimSpace(l) == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		// meta = unicode_char { unicode_char } colon { unicode_char } .
+		if i := strings.Index(l, ":"); i < 0 || strings.TrimSpace(l[:i]) == "" {
+			p.unread(raw)
+			return nil
+		}
+		lines = append(lines, l)
+	}
+	if len(lines) == 0 {
+		p.unread(raw)
+		return nil
+	}
+	if !closed {
+		p.errorf("Front matter is not terminated")
+	}
+	meta := make(map[string]string)
+	for _, l := range lines {
+		i := strings.Index(l, ":")
+		key := strings.TrimSpace(l[:i])
+		if _, ok := meta[key]; ok {
+			p.errorf("Duplicate front matter key: %s", key)
+		}
+		val := strings.TrimSpace(l[i+1:])
+		if len(val) >= 2 && (val[0] == '"' || val[0] == '\'') && val[len(val)-1] == val[0] {
+			val = val[1 : len(val)-1]
+		}
+		meta[key] = val
+	}
+	return meta
+}
+
 // citation = lbrack text rbrack colon string .
+// footnote = lbrack caret text rbrack colon text .
+//
+// The text of a footnote is formatted once the whole source has been parsed.
 func (p *parser) citation() ast.Stmt {
 	p.next()
 	label := p.str(func(r rune) bool { return r == ']' }, func(r rune) bool { return r == '\\' || r == ']' }, nil)
@@ -672,6 +1280,12 @@ func (p *parser) citation() ast.Stmt {
 		return p.paragraph("[" + label + "]")
 	}
 	p.next()
+	if strings.HasPrefix(label, "^") && len(label) > 1 {
+		return &ast.Footnote{
+			Label: label[1:],
+			Text:  ast.Text{Body: strings.TrimSpace(p.line(nil))},
+		}
+	}
 	src := strings.TrimSuffix(p.line(nil), "\n")
 	p.cite[label] = src
 	return &ast.Citation{
@@ -24,6 +24,7 @@
 package parser_test
 
 import (
+	"errors"
 	"fmt"
 	"reflect"
 	"sort"
@@ -51,6 +52,9 @@ func fileEquals(want, got ast.File) bool {
 			return false
 		}
 	}
+	if !reflect.DeepEqual(want.Meta, got.Meta) {
+		return false
+	}
 	for i := range want.List {
 		v1 := reflect.ValueOf(want.List[i])
 		v2 := reflect.ValueOf(got.List[i])
@@ -91,6 +95,21 @@ func TestSmall(t *testing.T) {
 		{"CombineListItem", combineListItem},
 		{"CombineParagraph", combineParagraph},
 		{"Unicode", unicodeSmall},
+		{"Position", positionSmall},
+		{"Attributes", attributesSmall},
+		{"FrontMatter", frontMatterSmall},
+		{"Ordered", orderedSmall},
+		{"Table", tableSmall},
+		{"Quote", quoteSmall},
+		{"Image", imageSmall},
+		{"Footnote", footnoteSmall},
+		{"Math", mathSmall},
+		{"InlineDirective", inlineDirectiveSmall},
+		{"Rule", ruleSmall},
+		{"Label", labelSmall},
+		{"Task", taskSmall},
+		{"Comment", commentSmall},
+		{"LineBreak", lineBreakSmall},
 	}
 	litCfg := litter.Options{
 		Compact:           true,
@@ -404,6 +423,373 @@ Second line.
 	},
 }
 
+var positionSmall = []smallcase{
+	{"```sh\n```", ast.File{
+		List: []ast.Stmt{
+			&ast.Directive{Command: "sh\n", Line: 1},
+		}}, nil,
+	},
+	{"First line.\n\n```\nraw\n```\n- item\n\n```sh\necho\n```", ast.File{
+		List: []ast.Stmt{
+			&ast.Paragraph{Body: "First line.\n\n"},
+			&ast.Directive{Raw: "raw\n", Line: 3},
+			&ast.List{Items: []ast.ListItem{
+				{Text: ast.Text{Body: " item"}},
+			}},
+			&ast.Directive{Command: "sh\n", Raw: "echo\n", Line: 8},
+		}}, nil,
+	},
+}
+
+var attributesSmall = []smallcase{
+	{"```{id=fig1 caption=\"Flow chart\" class='wide tall' hidden} dot -Tsvg\n```", ast.File{
+		List: []ast.Stmt{
+			&ast.Directive{
+				Command: "dot -Tsvg\n",
+				Line:    1,
+				Attrs: map[string]string{
+					"id":      "fig1",
+					"caption": "Flow chart",
+					"class":   "wide tall",
+					"hidden":  "",
+				},
+			},
+		}}, nil,
+	},
+	{"```{caption=\"\\\"Quoted\\\" }\\\\\"}\nraw\n```", ast.File{
+		List: []ast.Stmt{
+			&ast.Directive{
+				Raw:   "raw\n",
+				Line:  1,
+				Attrs: map[string]string{"caption": `"Quoted" }\`},
+			},
+		}}, nil,
+	},
+	{"```{id=fig1 dot\n```", ast.File{
+		List: []ast.Stmt{
+			&ast.Directive{
+				Command: "{id=fig1 dot\n",
+				Line:    1,
+				Attrs:   map[string]string{"id": "fig1", "dot": ""},
+			},
+		}}, errors.New("Invalid directive attributes: {id=fig1 dot: missing closing brace\n"),
+	},
+	{"```{ echo a; echo b; } | sort\n```", ast.File{
+		List: []ast.Stmt{
+			&ast.Directive{Command: "{ echo a; echo b; } | sort\n", Line: 1},
+		}}, nil,
+	},
+	{"```{}\n```", ast.File{
+		List: []ast.Stmt{
+			&ast.Directive{Command: "{}\n", Line: 1},
+		}}, nil,
+	},
+	{"```{name=x}cat\n```", ast.File{
+		List: []ast.Stmt{
+			&ast.Directive{Command: "{name=x}cat\n", Line: 1},
+		}}, nil,
+	},
+}
+
+var frontMatterSmall = []smallcase{
+	{"---\ntitle: A: B\nauthor:  \"Jane Doe\" \n\n# comment\ndate:\n---\n```cat\n```", ast.File{
+		List: []ast.Stmt{
+			&ast.Directive{Command: "cat\n", Line: 8},
+		},
+		Meta: map[string]string{
+			"title":  "A: B",
+			"author": "Jane Doe",
+			"date":   "",
+		},
+	}, nil},
+	{"----\nabc", ast.File{
+		List: []ast.Stmt{
+			&ast.Rule{},
+			&ast.Paragraph{Body: "abc"},
+		},
+	}, nil},
+	{"x\n---\na: b\n---\n", ast.File{
+		List: []ast.Stmt{
+			&ast.Paragraph{Body: "x\n"},
+			&ast.Rule{},
+			&ast.Paragraph{Body: "a: b\n"},
+			&ast.Rule{},
+		},
+	}, nil},
+	{"---\na: b\ntitle\n---\n", ast.File{
+		List: []ast.Stmt{
+			&ast.Rule{},
+			&ast.Paragraph{Body: "a: b\ntitle\n"},
+			&ast.Rule{},
+		},
+	}, nil},
+	{"---\ntitle\n---\n", ast.File{
+		List: []ast.Stmt{
+			&ast.Rule{},
+			&ast.Paragraph{Body: "title\n"},
+			&ast.Rule{},
+		},
+	}, nil},
+	{"---\na: b\n", ast.File{
+		List: []ast.Stmt{},
+		Meta: map[string]string{"a": "b"},
+	}, errors.New("Front matter is not terminated\n")},
+	{"---\na: b\n\ntext\n", ast.File{
+		List: []ast.Stmt{
+			&ast.Rule{},
+			&ast.Paragraph{Body: "a: b\n\ntext\n"},
+		},
+	}, nil},
+	{"---\n", ast.File{
+		List: []ast.Stmt{
+			&ast.Rule{},
+		},
+	}, nil},
+}
+
+var orderedSmall = []smallcase{
+	{"-# one\n\t-#3[a] two\n- three", ast.File{
+		List: []ast.Stmt{
+			&ast.List{Items: []ast.ListItem{
+				{Ordered: true, Text: ast.Text{Body: " one"}},
+				{NTab: 1, Ordered: true, Start: 3, HasStart: true, Label: ast.Text{Body: "a"}, Text: ast.Text{Body: " two"}},
+				{Text: ast.Text{Body: " three"}},
+			}},
+		}}, nil,
+	},
+	{"-#0 zero\n-#99999999999999999999 big", ast.File{
+		List: []ast.Stmt{
+			&ast.List{Items: []ast.ListItem{
+				{Ordered: true, HasStart: true, Text: ast.Text{Body: " zero"}},
+				{Ordered: true, Text: ast.Text{Body: " big"}},
+			}},
+		}}, errors.New("Invalid list start number: 99999999999999999999\n"),
+	},
+}
+
+var tableSmall = []smallcase{
+	{"| Name | *Type* |\n|:--|-:|---|:-:|\n| a\\|b | `c` \n|\n\nafter", ast.File{
+		List: []ast.Stmt{
+			&ast.Table{
+				Align:   []ast.Align{ast.AlignLeft, ast.AlignRight, ast.AlignNone, ast.AlignCenter},
+				NHeader: 1,
+				Rows: []ast.TableRow{
+					{Cells: []ast.TableCell{
+						{Text: ast.Text{Body: "Name"}},
+						{Text: ast.Text{Body: "*Type*", Format: []ast.Format{{Kind: ast.Italic, Beg: 0, End: 5}}}},
+					}},
+					{Cells: []ast.TableCell{
+						{Text: ast.Text{Body: "a|b"}},
+						{Text: ast.Text{Body: "`c`", Format: []ast.Format{{Kind: ast.Raw, Beg: 0, End: 2}}}},
+					}},
+				},
+			},
+			&ast.Paragraph{Body: "after"},
+		}}, nil,
+	},
+	{"|\n| a |", ast.File{
+		List: []ast.Stmt{
+			&ast.Table{
+				Rows: []ast.TableRow{
+					{Cells: []ast.TableCell{{Text: ast.Text{Body: "a"}}}},
+				},
+			},
+		}}, nil,
+	},
+	{"|a|b|\n|c|", ast.File{
+		List: []ast.Stmt{
+			&ast.Table{
+				Rows: []ast.TableRow{
+					{Cells: []ast.TableCell{{Text: ast.Text{Body: "a"}}, {Text: ast.Text{Body: "b"}}}},
+					{Cells: []ast.TableCell{{Text: ast.Text{Body: "c"}}}},
+				},
+			},
+		}}, nil,
+	},
+}
+
+var quoteSmall = []smallcase{
+	{"intro\n> *said*\n> - item\n>\n> ```cat\n> x\n> ```\n>> nested\n\\> not quoted", ast.File{
+		List: []ast.Stmt{
+			&ast.Paragraph{Body: "intro\n"},
+			&ast.Quote{List: []ast.Stmt{
+				&ast.Paragraph{Body: "*said*\n", Format: []ast.Format{{Kind: ast.Italic, Beg: 0, End: 5}}},
+				&ast.List{Items: []ast.ListItem{{Text: ast.Text{Body: " item"}}}},
+				&ast.Directive{Command: "cat\n", Raw: "x\n", Line: 5},
+				&ast.Quote{List: []ast.Stmt{
+					&ast.Paragraph{Body: "nested\n"},
+				}},
+			}},
+			&ast.Paragraph{Body: "> not quoted"},
+		}}, nil,
+	},
+}
+
+var imageSmall = []smallcase{
+	{"a ![b *c*](d) ! ![e] \\![f]", ast.File{
+		List: []ast.Stmt{
+			&ast.Paragraph{
+				Format: []ast.Format{
+					{Kind: ast.Image, Beg: 2, End: 12},
+					{Kind: ast.Image, Beg: 16, End: 19},
+					{Kind: ast.Cite, Beg: 22, End: 24},
+				},
+				Body: "a ![b *c*](d) ! ![e] ![f]",
+			},
+		}}, nil,
+	},
+}
+
+var footnoteSmall = []smallcase{
+	{"a[^n] [^](x)\n[^n]: *b*\n[^]: y", ast.File{
+		List: []ast.Stmt{
+			&ast.Paragraph{
+				Format: []ast.Format{
+					{Kind: ast.FootnoteRef, Beg: 1, End: 4},
+					{Kind: ast.Cite, Beg: 6, End: 11},
+				},
+				Body: "a[^n] [^](x)\n",
+			},
+			&ast.Footnote{Label: "n", Text: ast.Text{Body: "*b*", Format: []ast.Format{{Kind: ast.Italic, Beg: 0, End: 2}}}},
+			&ast.Citation{Label: "^", Src: " y"},
+		},
+		Cite: map[string]string{"^": " y"},
+	}, nil},
+}
+
+var mathSmall = []smallcase{
+	{"$a*b*c$ $$x_1_$$ \\$y$ $ z$ costs $5 or $10", ast.File{
+		List: []ast.Stmt{
+			&ast.Paragraph{
+				Format: []ast.Format{
+					{Kind: ast.Math, Beg: 0, End: 6},
+					{Kind: ast.DisplayMath, Beg: 9, End: 15},
+				},
+				Body: "$a*b*c$ $$x_1_$$ $y$ $ z$ costs $5 or $10",
+			},
+		}}, nil,
+	},
+}
+
+var inlineDirectiveSmall = []smallcase{
+	{"`!{date}` `!{}x` `!{echo \"}\"}*a*` `{\"a\": 1}` `{date}`", ast.File{
+		List: []ast.Stmt{
+			&ast.Paragraph{
+				Format: []ast.Format{
+					{Kind: ast.InlineDirective, Beg: 0, End: 8},
+					{Kind: ast.Raw, Beg: 10, End: 15},
+					{Kind: ast.InlineDirective, Beg: 17, End: 32},
+					{Kind: ast.Raw, Beg: 34, End: 43},
+					{Kind: ast.Raw, Beg: 45, End: 52},
+				},
+				Body: "`!{date}` `!{}x` `!{echo \"}\"}*a*` `{\"a\": 1}` `{date}`",
+			},
+		}}, nil,
+	},
+}
+
+var ruleSmall = []smallcase{
+	{"a\n--- \n- b\n----\n--c--\n===\n\\===", ast.File{
+		List: []ast.Stmt{
+			&ast.Paragraph{Body: "a\n"},
+			&ast.Rule{},
+			&ast.List{Items: []ast.ListItem{{Text: ast.Text{Body: " b"}}}},
+			&ast.Rule{},
+			&ast.Paragraph{
+				Format: []ast.Format{{Kind: ast.Strikethrough, Beg: 1, End: 4}},
+				Body:   "--c--\n",
+			},
+			&ast.PageBreak{},
+			&ast.Paragraph{Body: "==="},
+		}}, nil,
+	},
+}
+
+var labelSmall = []smallcase{
+	{"-[*a* [b](c)] x\n-[d\\]] y", ast.File{
+		List: []ast.Stmt{
+			&ast.List{Items: []ast.ListItem{
+				{
+					Label: ast.Text{
+						Format: []ast.Format{
+							{Kind: ast.Cite, Beg: 4, End: 9},
+							{Kind: ast.Italic, Beg: 0, End: 2},
+						},
+						Body: "*a* [b](c)",
+					},
+					Text: ast.Text{Body: " x"},
+				},
+				{Label: ast.Text{Body: "d]"}, Text: ast.Text{Body: " y"}},
+			}},
+		}}, nil,
+	},
+}
+
+var taskSmall = []smallcase{
+	{"-[ ] open\n-[x][*a*] done\n-#[X] n\n-[xy] z", ast.File{
+		List: []ast.Stmt{
+			&ast.List{Items: []ast.ListItem{
+				{Check: ast.CheckOpen, Text: ast.Text{Body: " open"}},
+				{
+					Check: ast.CheckDone,
+					Label: ast.Text{Format: []ast.Format{{Kind: ast.Italic, Beg: 0, End: 2}}, Body: "*a*"},
+					Text:  ast.Text{Body: " done"},
+				},
+				{Ordered: true, Check: ast.CheckDone, Text: ast.Text{Body: " n"}},
+				{Label: ast.Text{Body: "xy"}, Text: ast.Text{Body: " z"}},
+			}},
+		}}, nil,
+	},
+}
+
+var commentSmall = []smallcase{
+	{"a\n// TODO\n- b\n/* x\ny */ c\n\\// d http://e", ast.File{
+		List: []ast.Stmt{
+			&ast.Paragraph{Body: "a\n"},
+			&ast.Comment{Text: " TODO"},
+			&ast.List{Items: []ast.ListItem{{Text: ast.Text{Body: " b"}}}},
+			&ast.Comment{Text: " x\ny ", Block: true},
+			&ast.Paragraph{Body: " c\n// d http://e"},
+		}}, nil,
+	},
+	{"a\n// b\n/* c */\nd", ast.File{
+		List: []ast.Stmt{
+			&ast.Paragraph{Body: "a\nd"},
+			&ast.Comment{Text: " b"},
+			&ast.Comment{Text: " c ", Block: true},
+		}}, nil,
+	},
+	{"/* a", ast.File{
+		List: []ast.Stmt{
+			&ast.Comment{Text: " a", Block: true},
+		}}, errors.New("Block comment is not terminated: /* a\n"),
+	},
+}
+
+var lineBreakSmall = []smallcase{
+	{"roses\\\nviolets  \n*blue*  \n`c  \nd` e  \n\n", ast.File{
+		List: []ast.Stmt{
+			&ast.Paragraph{
+				Format: []ast.Format{
+					{Kind: ast.LineBreak, Beg: 5, End: 5},
+					{Kind: ast.LineBreak, Beg: 14, End: 15},
+					{Kind: ast.Italic, Beg: 17, End: 22},
+					{Kind: ast.LineBreak, Beg: 23, End: 24},
+					{Kind: ast.Raw, Beg: 26, End: 32},
+				},
+				Body: "roses\\\nviolets  \n*blue*  \n`c  \nd` e  \n\n",
+			},
+		}}, nil,
+	},
+}
+
+func TestCountTasks(t *testing.T) {
+	f := parser.MustParse(strings.NewReader("-[x] a\n-[ ] b\n\t-[X] c\n- d\n\n> -[ ] e"))
+	if done, total := ast.CountTasks(f); done != 2 || total != 4 {
+		t.Errorf("want 2 of 4 tasks done, got %d of %d", done, total)
+	}
+}
+
 const (
 	/*
 		For reference (English):